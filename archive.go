@@ -0,0 +1,74 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultArchiveURL is the base URL of a server implementing the Wayback Machine availability API:
+// https://archive.org/help/wayback_api.php
+const defaultArchiveURL = "https://archive.org"
+
+// findSnapshot uses the availability API at archiveURL to find an archived snapshot of u
+// captured no later than d. If d is empty, the most recent snapshot is used.
+// An empty string is returned if no suitable snapshot exists.
+func (p *prober) findSnapshot(ctx context.Context, archiveURL, u string, d date) (string, error) {
+	params := url.Values{"url": []string{u}}
+	if !d.empty() {
+		params.Set("timestamp", d.latest().Format("20060102"))
+	}
+	if err := p.limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		archiveURL+"/wayback/available?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %v: %v", resp.StatusCode, resp.Status)
+	}
+
+	var data struct {
+		ArchivedSnapshots struct {
+			Closest *struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+				Timestamp string `json:"timestamp"` // e.g. "20091026123456"
+				Status    string `json:"status"`    // e.g. "200"
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&data); err != nil {
+		return "", err
+	}
+	snap := data.ArchivedSnapshots.Closest
+	if snap == nil || !snap.Available || snap.Status != "200" || snap.URL == "" {
+		return "", nil
+	}
+	// The API returns the closest snapshot in either direction, so skip ones taken after d.
+	if !d.empty() {
+		t, err := time.Parse("20060102150405", snap.Timestamp)
+		if err != nil {
+			return "", fmt.Errorf("bad timestamp %q", snap.Timestamp)
+		}
+		if t.After(d.latest()) {
+			return "", nil
+		}
+	}
+	return snap.URL, nil
+}
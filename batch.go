@@ -0,0 +1,182 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// relBatch accumulates relationship changes for multiple entities so they can be
+// submitted to /relationship-editor in a single request. All changes in a submission
+// share the same edit note and votability, so the batch is flushed early if they differ.
+type relBatch struct {
+	srv         *server
+	size        int           // maximum number of entities per submission
+	verifyAfter time.Duration // see urlOptions.verifyAfter
+	report      *reporter     // receives failures attributed to individual entities
+
+	editNote    string
+	makeVotable bool
+	vals        map[string]string
+	rels        []relInfo
+	entries     []relBatchEntry
+	mbids       map[string]struct{}
+}
+
+// relBatchEntry describes a contiguous range of relationships in a relBatch that belong to one entity.
+type relBatchEntry struct {
+	mbid   string
+	name   string      // entity name used in relationship descriptions
+	verify *entityInfo // if non-nil, checked for concurrent changes before submitting
+	start  int         // index of first relationship in rel-editor.rels
+	n      int         // number of relationships
+}
+
+// newRelBatch returns a relBatch that submits changes for up to size entities at once.
+// Entities that were fetched more than verifyAfter before their changes are submitted
+// are checked for concurrent changes first.
+func newRelBatch(srv *server, size int, verifyAfter time.Duration, report *reporter) *relBatch {
+	return &relBatch{srv: srv, size: size, verifyAfter: verifyAfter, report: report}
+}
+
+// add adds the relationship changes in vals (as produced by setRelEditVals or setRelRemoveVals)
+// for rels, which belong to the entity described by ent's mbid and name fields. If ent.verify
+// is non-nil, the changes are dropped if the entity has changed by the time that they're
+// submitted. Previously-added changes may be submitted. A non-nil error is only returned if
+// the submission failed as a whole, e.g. due to an edit limit.
+func (b *relBatch) add(ctx context.Context, ent relBatchEntry, rels []relInfo,
+	vals map[string]string, editNote string, makeVotable bool) error {
+	n := countRelEdits(vals)
+	if n == 0 {
+		return nil
+	} else if n != len(rels) {
+		return fmt.Errorf("got %d relationship change(s) for %d relationship(s)", n, len(rels))
+	}
+	if len(b.entries) > 0 && (editNote != b.editNote || makeVotable != b.makeVotable) {
+		if err := b.flush(ctx); err != nil {
+			return err
+		}
+	}
+	if _, ok := b.mbids[ent.mbid]; !ok && len(b.mbids) >= b.size {
+		if err := b.flush(ctx); err != nil {
+			return err
+		}
+	}
+	if b.vals == nil {
+		b.vals = make(map[string]string)
+		b.mbids = make(map[string]struct{})
+	}
+
+	start := countRelEdits(b.vals)
+	if err := copyRelVals(b.vals, vals, start); err != nil {
+		return err
+	}
+	b.editNote = editNote
+	b.makeVotable = makeVotable
+	b.rels = append(b.rels, rels...)
+	ent.start, ent.n = start, n
+	b.entries = append(b.entries, ent)
+	b.mbids[ent.mbid] = struct{}{}
+	log.Printf("%v: queued %d relationship change(s)", ent.mbid, n)
+	return nil
+}
+
+// flush submits all accumulated changes.
+func (b *relBatch) flush(ctx context.Context) error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	entries, vals, rels := b.verify(ctx)
+	b.entries, b.vals, b.rels, b.mbids = nil, nil, nil, nil
+	if len(entries) == 0 {
+		return nil
+	}
+	return b.submit(ctx, entries, vals, rels)
+}
+
+// submit posts vals, which describe rels, and reports the outcomes for entries.
+// If the server rejects a submission containing multiple entries, each entry's changes
+// are resubmitted separately so that a single bad change doesn't prevent the others
+// from being applied.
+func (b *relBatch) submit(ctx context.Context, entries []relBatchEntry,
+	vals map[string]string, rels []relInfo) error {
+	log.Printf("Submitting %d relationship change(s) for %d entities", len(rels), len(entries))
+	outs, err := postRelEdit(ctx, b.srv, vals, rels, b.editNote, b.makeVotable)
+	if err != nil {
+		for _, ent := range entries {
+			b.report.add(ent.mbid, reportFailed, "%d batched relationship change(s) not submitted: %v", ent.n, err)
+		}
+		return err
+	}
+
+	var rej *relEditRejectedError
+	if len(entries) > 1 && errors.As(outs[0].err, &rej) {
+		log.Printf("Resubmitting changes for each entity separately after %v", rej)
+		for i, ent := range entries {
+			idxs := make([]int, ent.n)
+			for j := range idxs {
+				idxs[j] = ent.start + j
+			}
+			one := ent
+			one.start = 0
+			if err := b.submit(ctx, []relBatchEntry{one}, selectRelVals(vals, idxs),
+				rels[ent.start:ent.start+ent.n]); err != nil {
+				for _, ent := range entries[i+1:] {
+					b.report.add(ent.mbid, reportFailed, "%d batched relationship change(s) not submitted: %v", ent.n, err)
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, ent := range entries {
+		applied := reportRelOutcomes(b.report, ent.mbid, ent.name, outs[ent.start:ent.start+ent.n])
+		log.Printf("%v: submitted %d of %d relationship change(s)", ent.mbid, len(applied), ent.n)
+	}
+	return nil
+}
+
+// verify checks the batch's entities for concurrent changes. Changed entities are reported,
+// and the remaining entries are returned along with their renumbered values and relationships.
+func (b *relBatch) verify(ctx context.Context) ([]relBatchEntry, map[string]string, []relInfo) {
+	skip := make(map[string]bool)
+	for _, ent := range b.entries {
+		if ent.verify == nil || b.srv.dryRun || time.Since(ent.verify.fetched) <= b.verifyAfter {
+			continue
+		} else if _, ok := skip[ent.mbid]; ok {
+			continue // already checked
+		}
+		changed, err := entityChanged(ctx, b.srv, ent.verify)
+		if err != nil {
+			b.report.add(ent.mbid, reportFailed, "failed verifying %v: %v", ent.verify.name, err)
+		} else if changed {
+			b.report.add(ent.mbid, reportChanged, "%v changed concurrently", ent.verify.name)
+		}
+		skip[ent.mbid] = err != nil || changed
+	}
+
+	var entries []relBatchEntry
+	var rels []relInfo
+	var idxs []int
+	for _, ent := range b.entries {
+		if skip[ent.mbid] {
+			continue
+		}
+		for i := ent.start; i < ent.start+ent.n; i++ {
+			idxs = append(idxs, i)
+		}
+		rels = append(rels, b.rels[ent.start:ent.start+ent.n]...)
+		ent.start = len(rels) - ent.n
+		entries = append(entries, ent)
+	}
+	if len(entries) == len(b.entries) {
+		return b.entries, b.vals, b.rels
+	}
+	return entries, selectRelVals(b.vals, idxs), rels
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRelBatch(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		mbid1 = "11111111-1111-1111-1111-111111111111"
+		mbid2 = "22222222-2222-2222-2222-222222222222"
+		mbid3 = "33333333-3333-3333-3333-333333333333"
+	)
+	env.mbidURLs[mbid1] = "http://www.geocities.com/one"
+	env.mbidURLs[mbid2] = "http://www.geocities.com/two"
+	env.mbidURLs[mbid3] = "http://www.geocities.com/three"
+	env.mbidRels[mbid1] = []jsonRelationship{{ID: 1, LinkTypeID: 3}}
+	env.mbidRels[mbid2] = []jsonRelationship{{ID: 2, LinkTypeID: 3}, {ID: 3, LinkTypeID: 3}}
+	env.mbidRels[mbid3] = []jsonRelationship{{ID: 4, LinkTypeID: 3}}
+	env.relResponses = map[string]int{"3": 0}
+
+	var report strings.Builder
+	rep := newReporter(&report)
+	opts := urlOptions{report: rep, batch: newRelBatch(env.srv, 2, time.Hour, rep)}
+	for _, mbid := range []string{mbid1, mbid2, mbid3} {
+		if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+			t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+		}
+	}
+	if err := opts.batch.flush(ctx); err != nil {
+		t.Fatal("flush failed:", err)
+	}
+
+	// The first two URLs' changes should be submitted together, followed by the third URL's changes.
+	// The failed change shouldn't be retried.
+	var got [][]string
+	for _, req := range env.requests {
+		var ids []string
+		for i := 0; i < countRelEdits(flattenValues(req.params)); i++ {
+			ids = append(ids, req.params.Get(relEditPrefix+strconv.Itoa(i)+".id"))
+		}
+		if note := req.params.Get("rel-editor.edit_note"); note != geocitiesEditNote {
+			t.Errorf("%v posted with edit note %q; want %q", req.path, note, geocitiesEditNote)
+		}
+		got = append(got, ids)
+	}
+	if diff := cmp.Diff([][]string{{"1", "2", "3"}, {"4"}}, got); diff != "" {
+		t.Error("Bad submitted relationships:\n" + diff)
+	}
+
+	// The failure should be attributed to the second URL.
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], mbid2+"\t"+reportFailed+"\t") {
+		t.Errorf("Report is %q; want single %v line for %v", report.String(), reportFailed, mbid2)
+	}
+}
+
+func TestRelBatch_Rejected(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		mbid1 = "11111111-1111-1111-1111-111111111111"
+		mbid2 = "22222222-2222-2222-2222-222222222222"
+	)
+	env.mbidURLs[mbid1] = "http://www.geocities.com/one"
+	env.mbidURLs[mbid2] = "http://www.geocities.com/two"
+	env.mbidRels[mbid1] = []jsonRelationship{{ID: 1, LinkTypeID: 3}}
+	env.mbidRels[mbid2] = []jsonRelationship{{ID: 2, LinkTypeID: 3}}
+	env.relErrors = map[string]string{"2": "Relationship not found"}
+
+	var report strings.Builder
+	rep := newReporter(&report)
+	opts := urlOptions{report: rep, batch: newRelBatch(env.srv, 10, time.Hour, rep)}
+	for _, mbid := range []string{mbid1, mbid2} {
+		if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+			t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+		}
+	}
+	if err := opts.batch.flush(ctx); err != nil {
+		t.Fatal("flush failed:", err)
+	}
+
+	// After the combined submission is rejected, each URL's changes should be resubmitted
+	// separately so the first URL's change can be applied.
+	var got [][]string
+	for _, req := range env.requests {
+		var ids []string
+		for i := 0; i < countRelEdits(flattenValues(req.params)); i++ {
+			ids = append(ids, req.params.Get(relEditPrefix+strconv.Itoa(i)+".id"))
+		}
+		got = append(got, ids)
+	}
+	if diff := cmp.Diff([][]string{{"1", "2"}, {"1"}, {"2"}}, got); diff != "" {
+		t.Error("Bad submitted relationships:\n" + diff)
+	}
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], mbid2+"\t"+reportFailed+"\t") {
+		t.Errorf("Report is %q; want single %v line for %v", report.String(), reportFailed, mbid2)
+	}
+}
+
+func TestRelBatch_ChangedConcurrently(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		mbid1 = "11111111-1111-1111-1111-111111111111"
+		mbid2 = "22222222-2222-2222-2222-222222222222"
+	)
+	env.mbidURLs[mbid1] = "http://www.geocities.com/one"
+	env.mbidURLs[mbid2] = "http://www.geocities.com/two"
+	env.mbidRels[mbid1] = []jsonRelationship{{ID: 1, LinkTypeID: 3}}
+	env.mbidRels[mbid2] = []jsonRelationship{{ID: 2, LinkTypeID: 3}}
+
+	// processURL shouldn't verify the URLs, but the batch should verify them before submitting.
+	var report strings.Builder
+	rep := newReporter(&report)
+	opts := urlOptions{report: rep, verifyAfter: time.Hour, batch: newRelBatch(env.srv, 10, 0, rep)}
+	for _, mbid := range []string{mbid1, mbid2} {
+		if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+			t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+		}
+	}
+	env.mbidRels[mbid1][0].Ended = true
+	if err := opts.batch.flush(ctx); err != nil {
+		t.Fatal("flush failed:", err)
+	}
+
+	if len(env.requests) != 1 {
+		t.Fatalf("Got %d request(s); want 1", len(env.requests))
+	}
+	vals := flattenValues(env.requests[0].params)
+	if n, id := countRelEdits(vals), vals[relEditPrefix+"0.id"]; n != 1 || id != "2" {
+		t.Errorf("Submitted %d change(s) starting with relationship %q; want 1 for relationship 2", n, id)
+	}
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], mbid1+"\t"+reportChanged+"\t") {
+		t.Errorf("Report is %q; want single %v line for %v", report.String(), reportChanged, mbid1)
+	}
+}
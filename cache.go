@@ -0,0 +1,87 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// entityCache stores entity data fetched from a server on disk.
+type entityCache struct {
+	dir     string        // directory for the server; contains a subdirectory per entity type
+	ttl     time.Duration // maximum age of entries; 0 for no limit
+	refresh bool          // ignore existing entries (but still write new ones)
+	now     func() time.Time
+}
+
+// cacheEntry is the JSON representation of a cached entity.
+type cacheEntry struct {
+	Fetched time.Time       `json:"fetched"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// newEntityCache returns an entityCache that stores data from serverURL under dir.
+func newEntityCache(dir, serverURL string, ttl time.Duration, refresh bool) *entityCache {
+	return &entityCache{
+		dir:     filepath.Join(dir, url.PathEscape(serverURL)),
+		ttl:     ttl,
+		refresh: refresh,
+		now:     time.Now,
+	}
+}
+
+// path returns the path of the file containing the entity's data.
+func (c *entityCache) path(typ entityType, mbid string) string {
+	return filepath.Join(c.dir, string(typ), mbid+".json")
+}
+
+// get returns the cached data for the specified entity.
+// false is returned if the entity isn't cached or its entry is expired.
+func (c *entityCache) get(typ entityType, mbid string) ([]byte, bool) {
+	if c.refresh {
+		return nil, false
+	}
+	b, err := os.ReadFile(c.path(typ, mbid))
+	if err != nil {
+		return nil, false
+	}
+	var ent cacheEntry
+	if err := json.Unmarshal(b, &ent); err != nil {
+		return nil, false
+	}
+	if c.ttl > 0 && c.now().Sub(ent.Fetched) > c.ttl {
+		return nil, false
+	}
+	return ent.Data, true
+}
+
+// put saves data for the specified entity.
+func (c *entityCache) put(typ entityType, mbid string, data []byte) error {
+	b, err := json.Marshal(cacheEntry{Fetched: c.now(), Data: data})
+	if err != nil {
+		return err
+	}
+	p := c.path(typ, mbid)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
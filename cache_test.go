@@ -0,0 +1,114 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntityCache(t *testing.T) {
+	const mbid = "11111111-1111-1111-1111-111111111111"
+	dir := t.TempDir()
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newEntityCache(dir, "https://musicbrainz.org", time.Hour, false)
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.get(urlType, mbid); ok {
+		t.Error("get unexpectedly succeeded for empty cache")
+	}
+	if err := c.put(urlType, mbid, []byte(`{"a":1}`)); err != nil {
+		t.Fatal("put failed:", err)
+	}
+	if b, ok := c.get(urlType, mbid); !ok || string(b) != `{"a":1}` {
+		t.Errorf("get returned %q, %v; want %q, true", b, ok, `{"a":1}`)
+	}
+	if _, ok := c.get("artist", mbid); ok {
+		t.Error("get unexpectedly succeeded for different type")
+	}
+	if _, ok := newEntityCache(dir, "https://test.musicbrainz.org", 0, false).get(urlType, mbid); ok {
+		t.Error("get unexpectedly succeeded for different server")
+	}
+	if _, ok := newEntityCache(dir, "https://musicbrainz.org", 0, true).get(urlType, mbid); ok {
+		t.Error("get unexpectedly succeeded with refresh")
+	}
+	now = now.Add(2 * time.Hour)
+	if _, ok := c.get(urlType, mbid); ok {
+		t.Error("get unexpectedly succeeded for expired entry")
+	}
+}
+
+func TestProcessURL_Cache(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t, serverCache(t.TempDir(), 0, false))
+	defer env.close()
+
+	const mbid = "11111111-1111-1111-1111-111111111111"
+	env.mbidURLs[mbid] = "https://listen.tidal.com/artist/1"
+	info, err := getEntityInfo(ctx, env.srv, mbid, urlType)
+	if err != nil {
+		t.Fatal("getEntityInfo failed:", err)
+	} else if info.cached {
+		t.Error("First getEntityInfo call returned cached info")
+	}
+
+	// Someone else fixes the URL. The cached copy still needs to be rewritten,
+	// but processURL should refetch the URL and notice that it's now okay.
+	env.mbidURLs[mbid] = "https://tidal.com/artist/1"
+	if info, err := getEntityInfo(ctx, env.srv, mbid, urlType); err != nil {
+		t.Fatal("getEntityInfo failed:", err)
+	} else if !info.cached || info.name != "https://listen.tidal.com/artist/1" {
+		t.Errorf("Second getEntityInfo call returned %+v; want cached original URL", info)
+	}
+	if err := processURL(ctx, env.srv, mbid, &urlOptions{}); err != nil {
+		t.Fatal("processURL failed:", err)
+	}
+	if len(env.requests) != 0 {
+		t.Errorf("processURL sent %v; want no requests", env.requests)
+	}
+	if info, err := getEntityInfo(ctx, env.srv, mbid, urlType); err != nil {
+		t.Fatal("getEntityInfo failed:", err)
+	} else if info.name != "https://tidal.com/artist/1" {
+		t.Errorf("getEntityInfo returned %q after refetch; want updated URL", info.name)
+	}
+}
+
+func TestProcessURL_CacheDryRun(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	env := newTestEnv(ctx, t, serverCache(dir, 0, false), serverDryRun(true))
+	defer env.close()
+
+	const mbid = "11111111-1111-1111-1111-111111111111"
+	env.mbidURLs[mbid] = "https://listen.tidal.com/artist/1"
+	if _, err := getEntityInfo(ctx, env.srv, mbid, urlType); err != nil {
+		t.Fatal("getEntityInfo failed:", err)
+	}
+
+	// Only the entity should be cached, not the rest of the page's data.
+	b, err := os.ReadFile(env.srv.cache.path(urlType, mbid))
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(string(b), "stash") || !strings.Contains(string(b), mbid) {
+		t.Errorf("Cache entry %q doesn't contain only the entity", b)
+	}
+
+	// Dry runs shouldn't refetch cached URLs.
+	var fetches int
+	env.getHook = func(req *http.Request) {
+		if req.URL.Path == "/url/"+mbid+"/edit" {
+			fetches++
+		}
+	}
+	if err := processURL(ctx, env.srv, mbid, &urlOptions{}); err != nil {
+		t.Fatal("processURL failed:", err)
+	}
+	if fetches != 0 {
+		t.Errorf("processURL fetched the URL %d time(s) in dry-run mode; want 0", fetches)
+	}
+}
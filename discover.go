@@ -0,0 +1,276 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// discoverURLs reads URLs from the MusicBrainz export at p and runs them through the rule named
+// rule (or all non-explicit rules if empty) without accessing the network. The MBIDs of URLs that
+// would be changed are written to w, one per line, and the number of MBIDs is returned.
+// Rules that need network access (e.g. "dead-link") can't be used.
+//
+// If p is a directory, it should contain files from an mbdump archive (i.e. PostgreSQL COPY output)
+// including url, link, and l_*_url/l_url_* tables. Otherwise, p should be a file containing
+// newline-separated JSON objects describing URLs in the format used by /ws/2/url?inc=*-rels.
+func discoverURLs(ctx context.Context, p, rule string, w io.Writer) (int, error) {
+	if r := findURLRule(rule); r != nil && r.netFn != nil {
+		return 0, fmt.Errorf("rule %q requires network access", rule)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	fn := func(info *entityInfo) error {
+		res, err := runURLFunc(ctx, nil, info, rule)
+		if err != nil {
+			return fmt.Errorf("%v: %v", info.mbid, err)
+		} else if res == nil || len(res.flags) > 0 {
+			return nil
+		}
+		n++
+		_, err = fmt.Fprintln(w, info.mbid)
+		return err
+	}
+	if fi.IsDir() {
+		err = readDumpDir(p, fn)
+	} else {
+		var f *os.File
+		if f, err = os.Open(p); err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		err = readDumpJSON(f, fn)
+	}
+	return n, err
+}
+
+// dumpEntityTypes lists the entity types that can be linked to URLs in mbdump link tables.
+var dumpEntityTypes = []string{
+	"area", "artist", "event", "genre", "instrument", "label", "place",
+	"recording", "release", "release_group", "series", "work",
+}
+
+// urlLinkTable checks whether name is the name of a table (e.g. "l_artist_url" or
+// "l_url_work") linking URLs to another entity type. The other type is returned, along
+// with true if URLs are entity1.
+func urlLinkTable(name string) (target string, backward, ok bool) {
+	for _, typ := range dumpEntityTypes {
+		switch name {
+		case "l_" + typ + "_url":
+			return typ, true, true
+		case "l_url_" + typ:
+			return typ, false, true
+		}
+	}
+	return "", false, false
+}
+
+// readDumpDir reads URLs and their relationships from the mbdump directory dir
+// and passes each URL to fn.
+//
+// Since the dump's entity tables aren't read, relationships' targetMBID fields
+// contain the targets' database row IDs instead of MBIDs, and targetName is empty.
+func readDumpDir(dir string, fn func(info *entityInfo) error) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "l_*"))
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for _, p := range paths {
+		if _, _, ok := urlLinkTable(filepath.Base(p)); ok {
+			tables = append(tables, p)
+		}
+	}
+
+	// Columns: id, link, entity0, entity1, edits_pending, last_updated, link_order,
+	// entity0_credit, entity1_credit
+	readLinkRows := func(fn func(p string, row []string, ids [4]int) error) error {
+		for _, p := range tables {
+			if err := readCopyFile(p, 9, func(row []string) error {
+				var ids [4]int
+				for i := range ids {
+					var err error
+					if ids[i], err = copyInt(row[i]); err != nil {
+						return err
+					}
+				}
+				return fn(p, row, ids)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The link table contains rows for all relationships, so only load the ones used by URLs.
+	links := make(map[int]*relInfo)
+	if err := readLinkRows(func(p string, row []string, ids [4]int) error {
+		links[ids[1]] = nil
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Columns: id, link_type, begin_date_year, begin_date_month, begin_date_day,
+	// end_date_year, end_date_month, end_date_day, attribute_count, created, ended
+	if err := readCopyFile(filepath.Join(dir, "link"), 11, func(row []string) error {
+		id, err := copyInt(row[0])
+		if err != nil {
+			return err
+		}
+		if _, ok := links[id]; !ok {
+			return nil
+		}
+		var vals [7]int
+		for i := range vals {
+			if vals[i], err = copyInt(row[i+1]); err != nil {
+				return err
+			}
+		}
+		links[id] = &relInfo{
+			linkTypeID: vals[0],
+			beginDate:  date{vals[1], vals[2], vals[3]},
+			endDate:    date{vals[4], vals[5], vals[6]},
+			ended:      row[10] == "t",
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	rels := make(map[int][]relInfo) // keyed by URL row ID
+	if err := readLinkRows(func(p string, row []string, ids [4]int) error {
+		link := links[ids[1]]
+		if link == nil {
+			return fmt.Errorf("unknown link %d", ids[1])
+		}
+		rel := *link
+		rel.id = ids[0]
+		rel.targetType, rel.backward, _ = urlLinkTable(filepath.Base(p))
+		urlID, targetID, cred := ids[3], ids[2], row[7]
+		if !rel.backward {
+			urlID, targetID, cred = ids[2], ids[3], row[8]
+		}
+		rel.targetMBID = strconv.Itoa(targetID)
+		if cred != copyNull {
+			rel.targetCred = cred
+		}
+		rels[urlID] = append(rels[urlID], rel)
+		return nil
+	}); err != nil {
+		return err
+	}
+	links = nil // no longer needed
+
+	// Columns: id, gid, url, edits_pending, last_updated
+	return readCopyFile(filepath.Join(dir, "url"), 5, func(row []string) error {
+		id, err := copyInt(row[0])
+		if err != nil {
+			return err
+		}
+		return fn(&entityInfo{mbid: row[1], typ: urlType, name: row[2], rels: rels[id]})
+	})
+}
+
+// jsonDumpURL describes a URL in a /ws/2 JSON response.
+type jsonDumpURL struct {
+	ID        string `json:"id"`
+	Resource  string `json:"resource"`
+	Relations []struct {
+		Type         string   `json:"type"` // link type name, e.g. "free streaming"
+		TypeID       string   `json:"type-id"`
+		TargetType   string   `json:"target-type"`
+		Direction    string   `json:"direction"` // "forward" or "backward"
+		Begin        string   `json:"begin"`
+		End          string   `json:"end"`
+		Ended        bool     `json:"ended"`
+		AttributeIDs []string `json:"attribute-ids"`
+		TargetCredit string   `json:"target-credit"`
+	} `json:"relations"`
+}
+
+// readDumpJSON reads newline-separated /ws/2 JSON URL objects from r and passes each to fn.
+// Link types are resolved using linkTypes, first by MBID and then by name since catalogs
+// may not include MBIDs; unknown types are left as 0.
+// Since target entities are encoded in fields named after their types, their MBIDs and
+// names are extracted separately.
+func readDumpJSON(r io.Reader, fn func(info *entityInfo) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var ju jsonDumpURL
+		if err := json.Unmarshal(raw, &ju); err != nil {
+			return err
+		}
+		var targets struct {
+			Relations []map[string]json.RawMessage `json:"relations"`
+		}
+		if err := json.Unmarshal(raw, &targets); err != nil {
+			return err
+		}
+
+		info := entityInfo{mbid: ju.ID, typ: urlType, name: ju.Resource}
+		for i, jr := range ju.Relations {
+			rel := relInfo{
+				targetType: jr.TargetType,
+				backward:   jr.Direction == "backward",
+				ended:      jr.Ended,
+				targetCred: jr.TargetCredit,
+				attrs:      joinAttrs(jr.AttributeIDs),
+			}
+			lt := linkTypes.getByGID(jr.TypeID)
+			if lt == nil {
+				type0, type1 := string(urlType), jr.TargetType
+				if rel.backward {
+					type0, type1 = type1, type0
+				}
+				lt = linkTypes.find(type0, type1, jr.Type)
+			}
+			if lt != nil {
+				rel.linkTypeID = lt.ID
+			}
+			var err error
+			if rel.beginDate, err = parseDate(jr.Begin); err != nil {
+				return fmt.Errorf("%v: %v", ju.ID, err)
+			}
+			if rel.endDate, err = parseDate(jr.End); err != nil {
+				return fmt.Errorf("%v: %v", ju.ID, err)
+			}
+			if b, ok := targets.Relations[i][strings.ReplaceAll(jr.TargetType, "_", "-")]; ok {
+				var target struct {
+					ID    string `json:"id"`
+					Name  string `json:"name"`
+					Title string `json:"title"`
+				}
+				if err := json.Unmarshal(b, &target); err != nil {
+					return fmt.Errorf("%v: %v", ju.ID, err)
+				}
+				rel.targetMBID = target.ID
+				rel.targetName = target.Name
+				if rel.targetName == "" {
+					rel.targetName = target.Title
+				}
+			}
+			info.rels = append(info.rels, rel)
+		}
+		if err := fn(&info); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverURLs_DumpDir(t *testing.T) {
+	dir := t.TempDir()
+	for fn, data := range map[string]string{
+		"url": strings.Join([]string{
+			"1\t11111111-1111-1111-1111-111111111111\thttps://listen.tidal.com/album/123\t0\t2020-01-01 00:00:00+00",
+			"2\t22222222-2222-2222-2222-222222222222\thttps://tidal.com/album/456\t0\t2020-01-01 00:00:00+00",
+			"3\t33333333-3333-3333-3333-333333333333\thttp://www.geocities.com/foo/\t0\t2020-01-01 00:00:00+00",
+			"4\t44444444-4444-4444-4444-444444444444\thttp://www.geocities.com/bar/\t0\t2020-01-01 00:00:00+00",
+			"5\t55555555-5555-5555-5555-555555555555\thttps://example.org/\t0\t2020-01-01 00:00:00+00",
+		}, "\n") + "\n",
+		"link": strings.Join([]string{
+			"10\t183\t\\N\t\\N\t\\N\t\\N\t\\N\t\\N\t0\t2020-01-01 00:00:00+00\tf",
+			"11\t183\t2001\t\\N\t\\N\t2005\t3\t\\N\t0\t2020-01-01 00:00:00+00\tt",
+			"12\t1\t\\N\t\\N\t\\N\t\\N\t\\N\t\\N\t0\t2020-01-01 00:00:00+00\tf", // not used by URLs
+			"13\t90\t\\N\t\\N\t\\N\t\\N\t\\N\t\\N\t0\t2020-01-01 00:00:00+00\tf",
+		}, "\n") + "\n",
+		"l_artist_url": strings.Join([]string{
+			"100\t10\t5\t3\t0\t2020-01-01 00:00:00+00\t0\t\\N\t\\N",
+			"101\t11\t6\t4\t0\t2020-01-01 00:00:00+00\t0\tSome\\tArtist\t\\N",
+		}, "\n") + "\n",
+		"l_release_url":       "", // empty table
+		"l_release_group_url": "102\t13\t7\t5\t0\t2020-01-01 00:00:00+00\t0\t\\N\t\\N\n",
+		"l_artist_artist":     "103\t12\t1\t2\t0\t2020-01-01 00:00:00+00\t0\t\\N\t\\N\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, fn), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []entityInfo
+	if err := readDumpDir(dir, func(info *entityInfo) error {
+		got = append(got, *info)
+		return nil
+	}); err != nil {
+		t.Fatal("readDumpDir failed:", err)
+	}
+	if len(got) != 5 {
+		t.Fatalf("readDumpDir returned %d URL(s); want 5", len(got))
+	}
+	want := relInfo{id: 101, linkTypeID: 183, beginDate: date{2001, 0, 0}, endDate: date{2005, 3, 0},
+		ended: true, backward: true, targetType: "artist", targetMBID: "6", targetCred: "Some\tArtist"}
+	if len(got[3].rels) != 1 || got[3].rels[0] != want {
+		t.Errorf("readDumpDir returned rels %+v for URL 4; want %+v", got[3].rels, want)
+	}
+	want = relInfo{id: 102, linkTypeID: 90, backward: true, targetType: "release_group", targetMBID: "7"}
+	if len(got[4].rels) != 1 || got[4].rels[0] != want {
+		t.Errorf("readDumpDir returned rels %+v for URL 5; want %+v", got[4].rels, want)
+	}
+
+	// The first URL should be normalized, the third URL's relationship should be ended, and the
+	// fourth URL's relationship has already been ended.
+	var b bytes.Buffer
+	if n, err := discoverURLs(context.Background(), dir, "", &b); err != nil {
+		t.Fatal("discoverURLs failed:", err)
+	} else if want := "11111111-1111-1111-1111-111111111111\n33333333-3333-3333-3333-333333333333\n"; b.String() != want || n != 2 {
+		t.Errorf("discoverURLs returned %d and wrote %q; want 2 and %q", n, b.String(), want)
+	}
+	b.Reset()
+	for _, rule := range []string{"dead-link", "redirect"} {
+		if _, err := discoverURLs(context.Background(), dir, rule, &b); err == nil {
+			t.Errorf("discoverURLs unexpectedly accepted network rule %q", rule)
+		}
+	}
+	if n, err := discoverURLs(context.Background(), dir, "geocities", &b); err != nil {
+		t.Fatal("discoverURLs failed:", err)
+	} else if want := "33333333-3333-3333-3333-333333333333\n"; b.String() != want || n != 1 {
+		t.Errorf("discoverURLs with rule returned %d and wrote %q; want 1 and %q", n, b.String(), want)
+	}
+}
+
+func TestDiscoverURLs_JSON(t *testing.T) {
+	// Use the bundled catalog, which doesn't include link type MBIDs.
+	orig := linkTypes
+	defer func() { linkTypes = orig }()
+	linkTypes = mustParseLinkTypes(bundledLinkTypes)
+
+	p := filepath.Join(t.TempDir(), "urls.jsonl")
+	if err := os.WriteFile(p, []byte(`{"id": "1", "resource": "https://listen.tidal.com/album/123/track/456",
+  "relations": [{"type": "free streaming", "type-id": "00000000-0000-0000-0000-000000000268",
+    "target-type": "recording", "direction": "backward",
+    "begin": "2019", "end": null, "ended": false, "recording": {"id": "r1", "title": "Song"}}]}
+{"id": "2", "resource": "https://listen.tidal.com/album/123/track/456", "relations": []}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []entityInfo
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := readDumpJSON(f, func(info *entityInfo) error {
+		got = append(got, *info)
+		return nil
+	}); err != nil {
+		t.Fatal("readDumpJSON failed:", err)
+	}
+	want := relInfo{linkTypeID: 268, beginDate: date{2019, 0, 0}, backward: true,
+		targetType: "recording", targetMBID: "r1", targetName: "Song"}
+	if len(got) != 2 || len(got[0].rels) != 1 || got[0].rels[0] != want {
+		t.Errorf("readDumpJSON returned %+v; want rel %+v", got, want)
+	}
+
+	// Only the first URL is attached to something, so the second is skipped by the rule.
+	var b bytes.Buffer
+	if n, err := discoverURLs(context.Background(), p, "", &b); err != nil {
+		t.Fatal("discoverURLs failed:", err)
+	} else if b.String() != "1\n" || n != 1 {
+		t.Errorf("discoverURLs returned %d and wrote %q; want 1 and %q", n, b.String(), "1\n")
+	}
+}
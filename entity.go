@@ -6,9 +6,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"time"
 )
 
 // entityInfo describes an entity in the database.
@@ -17,6 +23,23 @@ type entityInfo struct {
 	typ  entityType
 	name string // or URL
 	rels []relInfo
+
+	lastUpdated string    // last-updated timestamp reported by server, if any
+	fetched     time.Time // when info was fetched from the server
+	cached      bool      // info was loaded from server's entityCache
+}
+
+// fingerprint returns a string summarizing info's data as fetched from the server.
+// If the fingerprint changes, the entity was edited.
+func (info *entityInfo) fingerprint() string {
+	rels := append([]relInfo(nil), info.rels...)
+	sort.Slice(rels, func(i, j int) bool { return rels[i].id < rels[j].id })
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", info.typ, info.name, info.lastUpdated)
+	for _, rel := range rels {
+		fmt.Fprintf(h, "%+v\n", rel)
+	}
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 type entityType string
@@ -26,7 +49,23 @@ const (
 )
 
 // getEntityInfo fetches information about an entity (identified by its MBID) from srv.
+// If srv has an entityCache, it is used.
 func getEntityInfo(ctx context.Context, srv *server, mbid string, typ entityType) (*entityInfo, error) {
+	if srv.cache != nil {
+		if b, ok := srv.cache.get(typ, mbid); ok {
+			// Entries written by older versions may contain other data.
+			if info, err := parseSourceEntity(b); err == nil && info.mbid == mbid {
+				info.cached = true
+				return info, nil
+			}
+		}
+	}
+	return getFreshEntityInfo(ctx, srv, mbid, typ)
+}
+
+// getFreshEntityInfo is like getEntityInfo but always fetches the entity from srv.
+// It should be used before submitting edits. The entity is still saved to srv's cache.
+func getFreshEntityInfo(ctx context.Context, srv *server, mbid string, typ entityType) (*entityInfo, error) {
 	b, err := srv.get(ctx, fmt.Sprintf("/%s/%s/edit", typ, mbid))
 	if err != nil {
 		return nil, err
@@ -52,30 +91,90 @@ func getEntityInfo(ctx context.Context, srv *server, mbid string, typ entityType
 		return nil, err
 	}
 	ent := &data.Stash.SourceEntity
+	info := ent.toEntityInfo()
+	info.fetched = time.Now()
+	if srv.cache != nil {
+		// $c also contains session and user data, so only the entity itself is cached.
+		if b, err := json.Marshal(ent); err != nil {
+			log.Printf("Failed marshaling %v: %v", mbid, err)
+		} else if err := srv.cache.put(typ, mbid, b); err != nil {
+			log.Printf("Failed caching %v: %v", mbid, err)
+		}
+	}
+	return info, nil
+}
+
+// parseSourceEntity parses the JSON-marshaled jsonSourceEntity object in b.
+func parseSourceEntity(b []byte) (*entityInfo, error) {
+	var ent jsonSourceEntity
+	if err := json.Unmarshal(b, &ent); err != nil {
+		return nil, err
+	}
+	return ent.toEntityInfo(), nil
+}
+
+func (ent *jsonSourceEntity) toEntityInfo() *entityInfo {
 	info := entityInfo{
-		mbid: ent.GID,
-		typ:  entityType(ent.EntityType),
-		name: ent.Name,
+		mbid:        ent.GID,
+		typ:         entityType(ent.EntityType),
+		name:        ent.Name,
+		lastUpdated: ent.LastUpdated,
 	}
 	for _, rel := range ent.Relationships {
 		info.rels = append(info.rels, rel.toRelInfo())
 	}
-	return &info, nil
+	return &info
+}
+
+// getEntityOpenEdits returns the number of open edits for the entity with the supplied MBID.
+func getEntityOpenEdits(ctx context.Context, srv *server, mbid string, typ entityType) (int, error) {
+	b, err := srv.get(ctx, fmt.Sprintf("/%s/%s/open_edits", typ, mbid))
+	if err != nil {
+		return 0, err
+	}
+	return parseEditCount(b)
+}
+
+// lookupURL returns the MBID of the URL entity for resource (e.g. "https://tidal.com/album/1").
+// An empty string is returned if no entity exists for resource.
+func lookupURL(ctx context.Context, srv *server, resource string) (string, error) {
+	b, err := srv.get(ctx, "/ws/2/url?fmt=json&resource="+url.QueryEscape(resource))
+	if isNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var data struct {
+		ID       string `json:"id"`
+		Resource string `json:"resource"`
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return "", err
+	}
+	if data.ID == "" {
+		return "", errors.New("missing ID")
+	}
+	return data.ID, nil
 }
 
 // jsonData corresponds to the window.__MB__.$c object.
 type jsonData struct {
 	Stash struct {
-		SourceEntity struct {
-			GID        string `json:"gid"`
-			EntityType string `json:"entityType"`
-			Name       string `json:"name"`
-
-			Relationships []jsonRelationship `json:"relationships"`
-		} `json:"source_entity"`
+		SourceEntity jsonSourceEntity `json:"source_entity"`
 	} `json:"stash"`
 }
 
+// jsonSourceEntity corresponds to the entity being edited within jsonData.
+type jsonSourceEntity struct {
+	GID        string `json:"gid"`
+	EntityType string `json:"entityType"`
+	Name       string `json:"name"`
+	// LastUpdated is a timestamp like "2021-03-04T05:06:07Z". It may be missing.
+	LastUpdated string `json:"last_updated"`
+
+	Relationships []jsonRelationship `json:"relationships"`
+}
+
 // jsonRelationship corresponds to a relationship in jsonData.
 type jsonRelationship struct {
 	ID            int        `json:"id"`
@@ -86,6 +185,17 @@ type jsonRelationship struct {
 	Ended         bool       `json:"ended"`
 	VerbosePhrase string     `json:"verbosePhrase"`
 	Target        jsonTarget `json:"target"`
+
+	Attributes    []jsonAttribute `json:"attributes"`
+	Entity0Credit string          `json:"entity0_credit"`
+	Entity1Credit string          `json:"entity1_credit"`
+}
+
+// jsonAttribute describes a link attribute within jsonRelationship.
+type jsonAttribute struct {
+	Type struct {
+		GID string `json:"gid"`
+	} `json:"type"`
 }
 
 // jsonTarget describes the target entity within jsonRelationship.
@@ -96,6 +206,14 @@ type jsonTarget struct {
 }
 
 func (jr *jsonRelationship) toRelInfo() relInfo {
+	var attrs []string
+	for _, a := range jr.Attributes {
+		attrs = append(attrs, a.Type.GID)
+	}
+	credit := jr.Entity1Credit
+	if jr.Backward {
+		credit = jr.Entity0Credit
+	}
 	return relInfo{
 		id:         jr.ID,
 		linkTypeID: jr.LinkTypeID,
@@ -107,6 +225,8 @@ func (jr *jsonRelationship) toRelInfo() relInfo {
 		targetMBID: jr.Target.GID,
 		targetName: jr.Target.Name,
 		targetType: jr.Target.EntityType,
+		targetCred: credit,
+		attrs:      joinAttrs(attrs),
 	}
 }
 
@@ -0,0 +1,163 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// defaultFixtureDir contains subdirectories named after rules in urlRules.
+// Each subdirectory contains JSON files that unmarshal to ruleFixture.
+var defaultFixtureDir = filepath.Join("testdata", "rules")
+
+// ruleFixture describes a URL that is passed to a rule and the expected result.
+type ruleFixture struct {
+	URL         string       `json:"url"`
+	Rels        []fixtureRel `json:"rels"`
+	Rewritten   string       `json:"rewritten"` // empty if the URL shouldn't be rewritten
+	UpdatedRels []fixtureRel `json:"updatedRels"`
+	NewURLs     []fixtureURL `json:"newURLs"`
+	Flags       []string     `json:"flags"` // reasons for flagging the URL for review
+}
+
+// fixtureRel is a JSON representation of relInfo.
+type fixtureRel struct {
+	ID         int      `json:"id"`
+	LinkType   int      `json:"linkType"`
+	TargetMBID string   `json:"targetMBID"`
+	TargetName string   `json:"targetName"`
+	TargetType string   `json:"targetType"`
+	TargetCred string   `json:"targetCredit"` // name that the target is credited as
+	Backward   bool     `json:"backward"`
+	BeginDate  string   `json:"beginDate"` // e.g. "2017-05-03", "2017-05", or "2017"
+	EndDate    string   `json:"endDate"`
+	Ended      bool     `json:"ended"`
+	Attrs      []string `json:"attrs"` // link attribute type MBIDs
+}
+
+func (fr *fixtureRel) toRelInfo() (relInfo, error) {
+	rel := relInfo{
+		id:         fr.ID,
+		linkTypeID: fr.LinkType,
+		targetMBID: fr.TargetMBID,
+		targetName: fr.TargetName,
+		targetType: fr.TargetType,
+		targetCred: fr.TargetCred,
+		backward:   fr.Backward,
+		ended:      fr.Ended,
+		attrs:      joinAttrs(fr.Attrs),
+	}
+	var err error
+	if rel.beginDate, err = parseDate(fr.BeginDate); err != nil {
+		return rel, err
+	}
+	if rel.endDate, err = parseDate(fr.EndDate); err != nil {
+		return rel, err
+	}
+	return rel, nil
+}
+
+// fixtureURL is a JSON representation of a new URL in urlResult.
+type fixtureURL struct {
+	URL  string       `json:"url"`
+	Rels []fixtureRel `json:"rels"`
+}
+
+// toRelInfos converts frs to relInfo objects. nil is returned if frs is empty.
+func toRelInfos(frs []fixtureRel) ([]relInfo, error) {
+	var rels []relInfo
+	for i := range frs {
+		rel, err := frs[i].toRelInfo()
+		if err != nil {
+			return nil, err
+		}
+		rels = append(rels, rel)
+	}
+	return rels, nil
+}
+
+// checkRuleFixtures runs each fixture under dir through the rule named by its subdirectory.
+// The number of fixtures that were checked is returned, along with errors describing failures.
+func checkRuleFixtures(dir string) (int, []error) {
+	var errs []error
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil {
+		return 0, []error{err}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := checkRuleFixture(p); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", p, err))
+		}
+	}
+	return len(paths), errs
+}
+
+// checkRuleFixture checks the ruleFixture at p.
+func checkRuleFixture(p string) error {
+	rule := filepath.Base(filepath.Dir(p))
+	if findURLRule(rule) == nil {
+		return fmt.Errorf("unknown rule %q", rule)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var fx ruleFixture
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fx); err != nil {
+		return err
+	}
+
+	orig := entityInfo{name: fx.URL, typ: urlType}
+	if orig.rels, err = toRelInfos(fx.Rels); err != nil {
+		return err
+	}
+	want := urlResult{rewritten: fx.Rewritten, flags: fx.Flags}
+	if want.rewritten == "" {
+		want.rewritten = fx.URL
+	}
+	if want.updatedRels, err = toRelInfos(fx.UpdatedRels); err != nil {
+		return err
+	}
+	for _, fu := range fx.NewURLs {
+		info := entityInfo{name: fu.URL, typ: urlType}
+		if info.rels, err = toRelInfos(fu.Rels); err != nil {
+			return err
+		}
+		want.newURLs = append(want.newURLs, info)
+	}
+
+	res, err := runURLFunc(context.Background(), nil, &orig, rule)
+	if err != nil {
+		return err
+	} else if res == nil {
+		if want.rewritten != fx.URL || len(want.updatedRels) > 0 || len(want.newURLs) > 0 || len(want.flags) > 0 {
+			return fmt.Errorf("not rewritten; want %q, %v, %v", want.rewritten, want.updatedRels, want.newURLs)
+		}
+		return nil
+	}
+	if res.rewritten != want.rewritten {
+		return fmt.Errorf("rewrote URL to %q; want %q", res.rewritten, want.rewritten)
+	}
+	if !reflect.DeepEqual(res.updatedRels, want.updatedRels) {
+		return fmt.Errorf("updated rels %v; want %v", res.updatedRels, want.updatedRels)
+	}
+	if !reflect.DeepEqual(res.newURLs, want.newURLs) {
+		return fmt.Errorf("added URLs %v; want %v", res.newURLs, want.newURLs)
+	}
+	if !reflect.DeepEqual(res.flags, want.flags) {
+		return fmt.Errorf("flagged %q; want %q", res.flags, want.flags)
+	}
+	return nil
+}
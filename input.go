@@ -0,0 +1,328 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pseudo-entity types used in inputItem.typ.
+const (
+	editType     entityType = "edit"     // edit IDs
+	resourceType entityType = "resource" // external URLs that need to be resolved to URL entities
+)
+
+// inputItem describes an entity or edit read from the input.
+type inputItem struct {
+	line int             // 1-based line number
+	typ  entityType      // e.g. urlType or editType; empty for bare MBIDs
+	id   string          // MBID, edit ID, or external URL
+	over *inputOverrides // settings from structured input; nil for text input
+}
+
+// inputCommentRegexp matches a comment at the start of a line or following whitespace.
+// Requiring whitespace avoids treating URL fragments as comments.
+var inputCommentRegexp = regexp.MustCompile(`(?:^|\s)#.*$`)
+
+// inputURLRegexp matches a MusicBrainz entity or edit URL, e.g.
+// https://musicbrainz.org/url/<mbid>, https://beta.musicbrainz.org/url/<mbid>/edit,
+// or https://musicbrainz.org/edit/123.
+var inputURLRegexp = regexp.MustCompile(`(?i)^https?://(?:[-a-z0-9]+\.)?musicbrainz\.(?:org|eu)` +
+	`/([a-z][-a-z]*)/([^/?#]+)(?:[/?#].*)?$`)
+
+// editIDRegexp matches a bare edit ID.
+var editIDRegexp = regexp.MustCompile(`^\d+$`)
+
+// parseInputLine parses a line of input containing a bare MBID, a bare edit ID,
+// or a MusicBrainz entity or edit URL. Trailing comments are ignored.
+// false is returned if the line doesn't contain anything.
+func parseInputLine(ln string) (inputItem, bool, error) {
+	ln = strings.TrimSpace(inputCommentRegexp.ReplaceAllString(ln, ""))
+	if ln == "" {
+		return inputItem{}, false, nil
+	}
+	if mbidRegexp.MatchString(ln) {
+		return inputItem{id: strings.ToLower(ln)}, true, nil
+	}
+	if editIDRegexp.MatchString(ln) {
+		return inputItem{typ: editType, id: ln}, true, nil
+	}
+	ms := inputURLRegexp.FindStringSubmatch(ln)
+	if ms == nil {
+		return inputItem{}, false, fmt.Errorf("unrecognized input %q", ln)
+	}
+	typ := entityType(strings.ReplaceAll(strings.ToLower(ms[1]), "-", "_"))
+	id := strings.ToLower(ms[2])
+	if typ == editType {
+		if !editIDRegexp.MatchString(id) {
+			return inputItem{}, false, fmt.Errorf("invalid edit ID %q", ms[2])
+		}
+	} else if !mbidRegexp.MatchString(id) {
+		return inputItem{}, false, fmt.Errorf("invalid MBID %q", ms[2])
+	}
+	return inputItem{typ: typ, id: id}, true, nil
+}
+
+// parseResourceLine parses a line of input containing an absolute http or https URL.
+// Trailing comments are ignored. false is returned if the line doesn't contain anything.
+func parseResourceLine(ln string) (inputItem, bool, error) {
+	ln = strings.TrimSpace(inputCommentRegexp.ReplaceAllString(ln, ""))
+	if ln == "" {
+		return inputItem{}, false, nil
+	}
+	if u, err := url.Parse(ln); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return inputItem{}, false, fmt.Errorf("invalid URL %q", ln)
+	}
+	return inputItem{typ: resourceType, id: ln}, true, nil
+}
+
+// resolveItem returns the MBID of the URL entity described by item.
+// If item contains an external URL, it is looked up using srv, and an empty
+// string is returned (and the URL is reported to rep) if it isn't in the database.
+func resolveItem(ctx context.Context, srv *server, item inputItem, rep *reporter) (string, error) {
+	if item.typ != resourceType {
+		return item.id, nil
+	}
+	mbid, err := lookupURL(ctx, srv, item.id)
+	if err != nil {
+		return "", fmt.Errorf("failed looking up %v: %v", item.id, err)
+	} else if mbid == "" {
+		rep.add(item.id, reportNotFound, "URL not in database")
+	}
+	return mbid, nil
+}
+
+// readInput reads lines from r and returns the items of type typ that they contain.
+// Bare MBIDs are assumed to be of type typ. Duplicate items are omitted. Invalid lines
+// (including items of other types) are reported to rep and skipped; an error is only
+// returned if r couldn't be read.
+func readInput(r io.Reader, typ entityType, rep *reporter) ([]inputItem, error) {
+	var items []inputItem
+	seen := make(map[string]struct{})
+	sc := bufio.NewScanner(r)
+	for num := 1; ; num++ {
+		ln, err := readLine(sc)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var item inputItem
+		var ok bool
+		if typ == resourceType {
+			item, ok, err = parseResourceLine(ln)
+		} else {
+			item, ok, err = parseInputLine(ln)
+		}
+		if err == nil && ok {
+			if item.typ == "" {
+				if typ == editType {
+					err = fmt.Errorf("expected edit ID; got MBID %v", item.id)
+				}
+				item.typ = typ
+			} else if item.typ != typ {
+				err = fmt.Errorf("expected %v; got %v %v", typ, item.typ, item.id)
+			}
+		}
+		if err != nil {
+			rep.add("line "+strconv.Itoa(num), reportInvalid, "%v", err)
+			continue
+		} else if !ok {
+			continue
+		}
+		if _, dup := seen[item.id]; dup {
+			continue
+		}
+		seen[item.id] = struct{}{}
+		item.line = num
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Values for the -input-format flag.
+const (
+	inputText  = "text"  // one MBID, entity URL, or edit ID per line
+	inputCSV   = "csv"   // CSV with a header row naming inputColumns
+	inputJSONL = "jsonl" // one JSON object per line with inputColumns as keys
+)
+
+var allInputFormats = []string{inputText, inputCSV, inputJSONL}
+
+// Columns (or JSON keys) in structured input.
+const (
+	colMBID        = "mbid"         // required; MBID or entity URL
+	colEditNote    = "edit_note"    // see urlOptions.editNote
+	colEndDate     = "end_date"     // see urlOptions.overrideEndDate
+	colRule        = "rule"         // see urlOptions.rule
+	colMakeVotable = "make_votable" // see urlOptions.makeVotable
+	colExistingURL = "existing_url" // see urlOptions.existingURL
+)
+
+var inputColumns = []string{colMBID, colEditNote, colEndDate, colRule, colMakeVotable, colExistingURL}
+
+// inputOverrides contains per-item settings read from structured input.
+// Zero values indicate that the corresponding setting isn't overridden.
+type inputOverrides struct {
+	editNote    string
+	endDate     date
+	rule        string
+	makeVotable *bool
+	existingURL string
+}
+
+// apply updates opts using o.
+func (o *inputOverrides) apply(opts *urlOptions) {
+	if o.editNote != "" {
+		opts.editNote = o.editNote
+	}
+	if !o.endDate.empty() {
+		opts.endDate = o.endDate
+		opts.overrideEndDate = o.endDate
+	}
+	if o.rule != "" {
+		opts.rule = o.rule
+	}
+	if o.makeVotable != nil {
+		opts.makeVotable = *o.makeVotable
+	}
+	if o.existingURL != "" {
+		opts.existingURL = o.existingURL
+	}
+}
+
+// readStructuredInput reads URL items with per-item overrides from r, which contains
+// data in the supplied format (inputCSV or inputJSONL). Like readInput, duplicate items
+// are omitted and invalid rows are reported to rep and skipped. An error is returned
+// if r couldn't be read or if it contains unknown columns.
+func readStructuredInput(r io.Reader, format string, rep *reporter) ([]inputItem, error) {
+	var rows []map[string]string
+	switch format {
+	case inputCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 0 // all rows must match the header
+		recs, err := cr.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(recs) == 0 {
+			return nil, nil
+		}
+		for _, col := range recs[0] {
+			if !sliceContains(inputColumns, col) {
+				return nil, fmt.Errorf("unknown column %q", col)
+			}
+		}
+		for _, rec := range recs[1:] {
+			row := make(map[string]string, len(rec))
+			for i, val := range rec {
+				row[recs[0][i]] = val
+			}
+			rows = append(rows, row)
+		}
+	case inputJSONL:
+		sc := bufio.NewScanner(r)
+		for num := 1; ; num++ {
+			ln, err := readLine(sc)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(ln) == "" {
+				rows = append(rows, nil)
+				continue
+			}
+			var obj map[string]interface{}
+			if err := json.Unmarshal([]byte(ln), &obj); err != nil {
+				rep.add("line "+strconv.Itoa(num), reportInvalid, "%v", err)
+				rows = append(rows, nil)
+				continue
+			}
+			row := make(map[string]string, len(obj))
+			for k, v := range obj {
+				if !sliceContains(inputColumns, k) {
+					return nil, fmt.Errorf("line %d: unknown key %q", num, k)
+				}
+				if v != nil {
+					row[k] = fmt.Sprint(v)
+				}
+			}
+			rows = append(rows, row)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	var items []inputItem
+	seen := make(map[string]struct{})
+	for i, row := range rows {
+		if row == nil {
+			continue // blank or already reported
+		}
+		num := i + 1
+		if format == inputCSV {
+			num++ // header
+		}
+		item, err := parseInputRow(row)
+		if err != nil {
+			rep.add("line "+strconv.Itoa(num), reportInvalid, "%v", err)
+			continue
+		}
+		if _, dup := seen[item.id]; dup {
+			continue
+		}
+		seen[item.id] = struct{}{}
+		item.line = num
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseInputRow parses a row of structured input.
+func parseInputRow(row map[string]string) (inputItem, error) {
+	item, ok, err := parseInputLine(row[colMBID])
+	if err != nil {
+		return item, err
+	} else if !ok {
+		return item, fmt.Errorf("missing %v", colMBID)
+	} else if item.typ != "" && item.typ != urlType {
+		return item, fmt.Errorf("expected %v; got %v %v", urlType, item.typ, item.id)
+	}
+	item.typ = urlType
+
+	var over inputOverrides
+	over.editNote = row[colEditNote]
+	if over.endDate, err = parseDate(row[colEndDate]); err == nil {
+		err = over.endDate.validate()
+	}
+	if err != nil {
+		return item, fmt.Errorf("bad %v: %v", colEndDate, err)
+	}
+	if over.rule = row[colRule]; over.rule != "" && findURLRule(over.rule) == nil {
+		return item, fmt.Errorf("unknown rule %q", over.rule)
+	}
+	if s := row[colMakeVotable]; s != "" {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return item, fmt.Errorf("bad %v: %v", colMakeVotable, err)
+		}
+		over.makeVotable = &v
+	}
+	if over.existingURL = row[colExistingURL]; over.existingURL != "" &&
+		!sliceContains(allExistingURLs, over.existingURL) {
+		return item, fmt.Errorf("bad %v %q", colExistingURL, over.existingURL)
+	}
+	item.over = &over
+	return item, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadInput(t *testing.T) {
+	const (
+		mbid1 = "11111111-1111-1111-1111-111111111111"
+		mbid2 = "22222222-2222-2222-2222-222222222222"
+		mbid3 = "33333333-3333-3333-3333-333333333333"
+	)
+	input := strings.Join([]string{
+		"# URLs to fix",
+		mbid1,
+		"",
+		"https://musicbrainz.org/url/" + mbid2 + "  # trailing comment",
+		"https://beta.musicbrainz.org/url/" + strings.ToUpper(mbid3) + "/edit",
+		mbid1, // duplicate
+		"https://musicbrainz.org/artist/" + mbid2,
+		"bogus",
+		"https://musicbrainz.org/url/123",
+	}, "\n")
+
+	var b bytes.Buffer
+	got, err := readInput(strings.NewReader(input), urlType, newReporter(&b))
+	if err != nil {
+		t.Fatal("readInput failed:", err)
+	}
+	want := []inputItem{
+		{line: 2, typ: urlType, id: mbid1},
+		{line: 4, typ: urlType, id: mbid2},
+		{line: 5, typ: urlType, id: mbid3},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(inputItem{})); diff != "" {
+		t.Error("readInput returned unexpected items:\n" + diff)
+	}
+	var lines []string
+	for _, ln := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		lines = append(lines, strings.Join(strings.Split(ln, "\t")[:2], " "))
+	}
+	if diff := cmp.Diff([]string{"line 7 invalid", "line 8 invalid", "line 9 invalid"}, lines); diff != "" {
+		t.Error("readInput reported unexpected lines:\n" + diff)
+	}
+
+	input = "123\nhttps://musicbrainz.org/edit/456#note\n" + mbid1 + "\n123\n"
+	got, err = readInput(strings.NewReader(input), editType, nil)
+	if err != nil {
+		t.Fatal("readInput failed:", err)
+	}
+	want = []inputItem{{line: 1, typ: editType, id: "123"}, {line: 2, typ: editType, id: "456"}}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(inputItem{})); diff != "" {
+		t.Error("readInput returned unexpected edit items:\n" + diff)
+	}
+}
+
+func TestResolveItem(t *testing.T) {
+	const (
+		mbid = "40d2c699-f615-4f95-b212-24c344572333"
+		url  = "http://www.geocities.com/foo/"
+	)
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+	env.mbidURLs[mbid] = url
+
+	items, err := readInput(strings.NewReader(url+"\nhttp://www.geocities.com/bar/#frag\nnot-a-url\n"), resourceType, nil)
+	if err != nil {
+		t.Fatal("readInput failed:", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("readInput returned %+v; want 2 items", items)
+	}
+
+	var b bytes.Buffer
+	rep := newReporter(&b)
+	if got, err := resolveItem(ctx, env.srv, items[0], rep); err != nil || got != mbid {
+		t.Errorf("resolveItem(ctx, srv, %+v, rep) = %q, %v; want %q, nil", items[0], got, err, mbid)
+	}
+	if got, err := resolveItem(ctx, env.srv, items[1], rep); err != nil || got != "" {
+		t.Errorf("resolveItem(ctx, srv, %+v, rep) = %q, %v; want %q, nil", items[1], got, err, "")
+	}
+	if want := "http://www.geocities.com/bar/#frag\t" + reportNotFound + "\tURL not in database\n"; b.String() != want {
+		t.Errorf("resolveItem reported %q; want %q", b.String(), want)
+	}
+	item := inputItem{typ: urlType, id: mbid}
+	if got, err := resolveItem(ctx, env.srv, item, rep); err != nil || got != mbid {
+		t.Errorf("resolveItem(ctx, srv, %+v, rep) = %q, %v; want %q, nil", item, got, err, mbid)
+	}
+}
+
+func TestReadStructuredInput(t *testing.T) {
+	const (
+		mbid1 = "11111111-1111-1111-1111-111111111111"
+		mbid2 = "22222222-2222-2222-2222-222222222222"
+		mbid3 = "33333333-3333-3333-3333-333333333333"
+	)
+	yes, no := true, false
+	want := []inputItem{
+		{line: 2, typ: urlType, id: mbid1, over: &inputOverrides{}},
+		{line: 3, typ: urlType, id: mbid2, over: &inputOverrides{
+			editNote:    "site closed",
+			endDate:     date{2015, 3, 0},
+			rule:        "geocities",
+			makeVotable: &yes,
+			existingURL: existingURLMerge,
+		}},
+		{line: 4, typ: urlType, id: mbid3, over: &inputOverrides{makeVotable: &no}},
+	}
+	opt := cmp.AllowUnexported(inputItem{}, inputOverrides{}, date{})
+
+	for _, tc := range []struct {
+		format, input string
+	}{
+		{inputCSV, strings.Join([]string{
+			"mbid,edit_note,end_date,rule,make_votable,existing_url",
+			mbid1 + ",,,,,",
+			"https://musicbrainz.org/url/" + mbid2 + `,site closed,2015-03,geocities,true,merge`,
+			mbid3 + ",,,,0,",
+			mbid1 + ",dup,,,,",
+			"bogus,,,,,",
+			mbid2 + ",,2015-02-30,,,",
+			mbid2 + ",,,bogus,,",
+			mbid2 + ",,,,maybe,",
+			mbid2 + ",,,,,bogus",
+		}, "\n")},
+		{inputJSONL, strings.Join([]string{
+			`{"mbid": "` + mbid1 + `", "edit_note": null}`,
+			`{"mbid": "https://musicbrainz.org/url/` + mbid2 + `", "edit_note": "site closed", ` +
+				`"end_date": "2015-03", "rule": "geocities", "make_votable": true, "existing_url": "merge"}`,
+			`{"mbid": "` + mbid3 + `", "make_votable": false}`,
+			`{"mbid": "` + mbid1 + `", "edit_note": "dup"}`,
+			`{"mbid": "bogus"}`,
+			`{"mbid": "` + mbid2 + `", "end_date": "2015-02-30"}`,
+			`{"mbid": "` + mbid2 + `", "rule": "bogus"}`,
+			`{"mbid": "` + mbid2 + `", "existing_url": "bogus"}`,
+			`not json`,
+		}, "\n")},
+	} {
+		var b bytes.Buffer
+		got, err := readStructuredInput(strings.NewReader(tc.input), tc.format, newReporter(&b))
+		if err != nil {
+			t.Errorf("readStructuredInput(..., %q, ...) failed: %v", tc.format, err)
+			continue
+		}
+		w := want
+		if tc.format == inputJSONL {
+			w = nil
+			for _, item := range want {
+				item.line--
+				w = append(w, item)
+			}
+		}
+		if diff := cmp.Diff(w, got, opt); diff != "" {
+			t.Errorf("readStructuredInput(..., %q, ...) returned unexpected items:\n%s", tc.format, diff)
+		}
+		if n := strings.Count(b.String(), "\t"+reportInvalid+"\t"); n != 5 {
+			t.Errorf("readStructuredInput(..., %q, ...) reported %d invalid row(s); want 5:\n%s", tc.format, n, b.String())
+		}
+	}
+
+	for _, tc := range []struct {
+		format, input string
+	}{
+		{inputCSV, "mbid,note\n" + mbid1 + ",foo\n"},
+		{inputJSONL, `{"mbid": "` + mbid1 + `", "note": "foo"}`},
+	} {
+		if _, err := readStructuredInput(strings.NewReader(tc.input), tc.format, nil); err == nil {
+			t.Errorf("readStructuredInput(%q, %q, nil) unexpectedly accepted unknown column", tc.input, tc.format)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+)
+
+// relDir describes the direction of a relationship from the perspective of its source entity.
+type relDir int
+
+const (
+	dirAny      relDir = iota // either direction
+	dirForward                // source entity is entity0
+	dirBackward               // source entity is entity1
+)
+
+// linkTypeMapping declaratively describes how link types should be remapped by a linkTypeMap.
+type linkTypeMapping struct {
+	targets []string // target entity types, e.g. "artist", "release"
+	dir     relDir   // direction of relationships to remap
+	from    []string // names of link types to remap; empty to remap any link type
+	to      string   // name of link type to remap to
+}
+
+// linkTypeMap remaps relationships' link types based on their target entity types and directions.
+type linkTypeMap struct {
+	entries []linkTypeMapEntry
+}
+
+// linkTypeMapEntry holds a linkTypeMapping resolved against a linkTypeCatalog for a single target type.
+type linkTypeMapEntry struct {
+	target string
+	dir    relDir
+	from   map[int]struct{} // nil to match any link type
+	to     int
+}
+
+// newLinkTypeMap returns a linkTypeMap that remaps relationships belonging to entities of type src.
+// Link type names in mappings are resolved using cat, and an error is returned if any are missing.
+// Earlier mappings take precedence over later ones.
+func newLinkTypeMap(cat *linkTypeCatalog, src entityType, mappings ...linkTypeMapping) (*linkTypeMap, error) {
+	var m linkTypeMap
+	for _, mp := range mappings {
+		if len(mp.targets) == 0 {
+			return nil, fmt.Errorf("no target types for %q", mp.to)
+		}
+		for _, target := range mp.targets {
+			ent := linkTypeMapEntry{target: target, dir: mp.dir}
+			to := findDir(cat, src, target, mp.dir, mp.to)
+			if to == nil {
+				return nil, fmt.Errorf("no %q link type between %v and %v", mp.to, src, target)
+			}
+			ent.to = to.ID
+			if len(mp.from) > 0 {
+				ent.from = make(map[int]struct{}, len(mp.from))
+				for _, name := range mp.from {
+					lt := findDir(cat, src, target, mp.dir, name)
+					if lt == nil {
+						return nil, fmt.Errorf("no %q link type between %v and %v", name, src, target)
+					}
+					ent.from[lt.ID] = struct{}{}
+				}
+			}
+			m.entries = append(m.entries, ent)
+		}
+	}
+	return &m, nil
+}
+
+// ruleLinkTypeMap is a linkTypeMap that is built from linkTypes when it's used,
+// so that catalogs loaded after package initialization (e.g. via -link-types) are honored.
+type ruleLinkTypeMap struct {
+	src      entityType
+	mappings []linkTypeMapping
+	cat      *linkTypeCatalog // catalog used to build m
+	m        *linkTypeMap
+}
+
+// ruleLinkTypeMaps contains all maps created by mustNewLinkTypeMap.
+var ruleLinkTypeMaps []*ruleLinkTypeMap
+
+// mustNewLinkTypeMap returns a ruleLinkTypeMap for the supplied mappings. It panics if the
+// mappings can't be resolved using linkTypes, and is intended to be used to initialize rules.
+func mustNewLinkTypeMap(src entityType, mappings ...linkTypeMapping) *ruleLinkTypeMap {
+	rm := &ruleLinkTypeMap{src: src, mappings: mappings}
+	if err := rm.build(); err != nil {
+		panic(fmt.Sprint("bad link type map: ", err))
+	}
+	ruleLinkTypeMaps = append(ruleLinkTypeMaps, rm)
+	return rm
+}
+
+// build rebuilds rm's map using linkTypes if it was built using a different catalog.
+func (rm *ruleLinkTypeMap) build() error {
+	if rm.cat == linkTypes {
+		return nil
+	}
+	m, err := newLinkTypeMap(linkTypes, rm.src, rm.mappings...)
+	if err != nil {
+		return err
+	}
+	rm.cat, rm.m = linkTypes, m
+	return nil
+}
+
+// remap is like linkTypeMap.remap. It panics if rm can't be built using linkTypes;
+// rebuildLinkTypeMaps should be called after changing linkTypes to catch errors.
+func (rm *ruleLinkTypeMap) remap(rel *relInfo) int {
+	if err := rm.build(); err != nil {
+		panic(fmt.Sprint("bad link type map: ", err))
+	}
+	return rm.m.remap(rel)
+}
+
+// rebuildLinkTypeMaps rebuilds all maps created by mustNewLinkTypeMap using linkTypes.
+// It should be called after linkTypes is replaced.
+func rebuildLinkTypeMaps() error {
+	for _, rm := range ruleLinkTypeMaps {
+		if err := rm.build(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findDir looks up the link type with the supplied name between src and target in cat.
+// If dir is dirAny, both orderings of the entity types are checked.
+func findDir(cat *linkTypeCatalog, src entityType, target string, dir relDir, name string) *linkType {
+	if dir != dirBackward {
+		if lt := cat.find(string(src), target, name); lt != nil {
+			return lt
+		}
+	}
+	if dir != dirForward {
+		return cat.find(target, string(src), name)
+	}
+	return nil
+}
+
+// remap returns the link type ID that rel should use.
+// rel's existing link type ID is returned if no mapping matches it.
+func (m *linkTypeMap) remap(rel *relInfo) int {
+	dir := dirForward
+	if rel.backward {
+		dir = dirBackward
+	}
+	for _, ent := range m.entries {
+		if ent.target != rel.targetType || (ent.dir != dirAny && ent.dir != dir) {
+			continue
+		}
+		if ent.from != nil {
+			if _, ok := ent.from[rel.linkTypeID]; !ok {
+				continue
+			}
+		}
+		return ent.to
+	}
+	return rel.linkTypeID
+}
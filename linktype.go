@@ -0,0 +1,175 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// bundledLinkTypes contains a snapshot of the link types used by this program's rules.
+// It doesn't include MBIDs. It's used unless a more-complete catalog (e.g. the link_type
+// table from an mbdump archive) is loaded via -link-types.
+//
+//go:embed data/link_types.json
+var bundledLinkTypes []byte
+
+// linkTypes is the catalog used to look up and validate link types.
+var linkTypes = mustParseLinkTypes(bundledLinkTypes)
+
+// linkType describes a type of relationship between two entity types,
+// e.g. "purchase for download" between artists and URLs.
+type linkType struct {
+	ID         int    `json:"id"`   // database ID, e.g. 176
+	GID        string `json:"gid"`  // MBID (optional)
+	Name       string `json:"name"` // e.g. "purchase for download"
+	Type0      string `json:"type0"`
+	Type1      string `json:"type1"`
+	LinkPhrase string `json:"linkPhrase"` // from entity0 to entity1
+	HasDates   bool   `json:"hasDates"`   // relationships can have begin and end dates
+}
+
+// linkTypeCatalog holds linkTypes keyed by ID and GID.
+type linkTypeCatalog struct {
+	byID  map[int]*linkType
+	byGID map[string]*linkType
+}
+
+// parseLinkTypes parses a JSON array of linkType objects.
+func parseLinkTypes(b []byte) (*linkTypeCatalog, error) {
+	var lts []*linkType
+	if err := json.Unmarshal(b, &lts); err != nil {
+		return nil, err
+	}
+	return newLinkTypeCatalog(lts)
+}
+
+// newLinkTypeCatalog returns a catalog containing lts.
+func newLinkTypeCatalog(lts []*linkType) (*linkTypeCatalog, error) {
+	cat := linkTypeCatalog{
+		byID:  make(map[int]*linkType, len(lts)),
+		byGID: make(map[string]*linkType, len(lts)),
+	}
+	for _, lt := range lts {
+		if lt.ID <= 0 || lt.Name == "" || lt.Type0 == "" || lt.Type1 == "" {
+			return nil, fmt.Errorf("incomplete link type %+v", *lt)
+		}
+		if _, ok := cat.byID[lt.ID]; ok {
+			return nil, fmt.Errorf("duplicate link type %d", lt.ID)
+		}
+		cat.byID[lt.ID] = lt
+		if lt.GID != "" {
+			cat.byGID[lt.GID] = lt
+		}
+	}
+	return &cat, nil
+}
+
+func mustParseLinkTypes(b []byte) *linkTypeCatalog {
+	cat, err := parseLinkTypes(b)
+	if err != nil {
+		panic(fmt.Sprint("bad link types: ", err))
+	}
+	return cat
+}
+
+// loadLinkTypes reads link types from p, which can be a JSON file containing an array of
+// linkType objects, the link_type table from an mbdump archive, or an mbdump directory.
+func loadLinkTypes(p string) (*linkTypeCatalog, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return readLinkTypeTable(filepath.Join(p, "link_type"))
+	} else if filepath.Base(p) == "link_type" {
+		return readLinkTypeTable(p)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return parseLinkTypes(b)
+}
+
+// useLinkTypes replaces linkTypes with the catalog loaded from p by loadLinkTypes
+// and rebuilds the link type maps used by rules.
+func useLinkTypes(p string) error {
+	cat, err := loadLinkTypes(p)
+	if err != nil {
+		return err
+	}
+	linkTypes = cat
+	if err := rebuildLinkTypeMaps(); err != nil {
+		return fmt.Errorf("missing types used by rules: %v", err)
+	}
+	return nil
+}
+
+// readLinkTypeTable reads all link types (including ones not involving URLs) from the
+// mbdump link_type table at p.
+func readLinkTypeTable(p string) (*linkTypeCatalog, error) {
+	var lts []*linkType
+	// Columns: id, parent, child_order, gid, entity_type0, entity_type1, name, description,
+	// link_phrase, reverse_link_phrase, long_link_phrase, last_updated, is_deprecated,
+	// has_dates, entity0_cardinality, entity1_cardinality
+	if err := readCopyFile(p, 16, func(row []string) error {
+		id, err := copyInt(row[0])
+		if err != nil {
+			return err
+		}
+		lts = append(lts, &linkType{
+			ID:         id,
+			GID:        row[3],
+			Name:       row[6],
+			Type0:      row[4],
+			Type1:      row[5],
+			LinkPhrase: row[10],
+			HasDates:   row[13] == "t",
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return newLinkTypeCatalog(lts)
+}
+
+// get returns the link type with the supplied database ID, or nil if it isn't in the catalog.
+func (cat *linkTypeCatalog) get(id int) *linkType { return cat.byID[id] }
+
+// getByGID returns the link type with the supplied MBID, or nil if it isn't in the catalog.
+func (cat *linkTypeCatalog) getByGID(gid string) *linkType { return cat.byGID[gid] }
+
+// find returns the link type with the supplied name between type0 and type1,
+// or nil if it isn't in the catalog.
+func (cat *linkTypeCatalog) find(type0, type1, name string) *linkType {
+	for _, lt := range cat.byID {
+		if lt.Type0 == type0 && lt.Type1 == type1 && lt.Name == name {
+			return lt
+		}
+	}
+	return nil
+}
+
+// validate checks that rel, which belongs to an entity of type src, uses a link type
+// that is valid for the entity types and direction. Link types missing from the catalog
+// are not checked.
+func (cat *linkTypeCatalog) validate(rel *relInfo, src entityType) error {
+	lt := cat.get(rel.linkTypeID)
+	if lt == nil {
+		return nil
+	}
+	type0, type1 := string(src), rel.targetType
+	if rel.backward {
+		type0, type1 = type1, type0
+	}
+	if lt.Type0 != type0 || lt.Type1 != type1 {
+		return fmt.Errorf("link type %d (%q) is between %v and %v, not %v and %v",
+			lt.ID, lt.Name, lt.Type0, lt.Type1, type0, type1)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkTypeCatalog(t *testing.T) {
+	cat, err := parseLinkTypes([]byte(`[
+		{"id": 176, "gid": "bb6d5f01-4c32-4d8a-8e98-1b37e2ba2b5b", "name": "purchase for download",
+		 "type0": "artist", "type1": "url", "hasDates": true},
+		{"id": 10, "name": "test", "type0": "url", "type1": "work"}
+	]`))
+	if err != nil {
+		t.Fatal("parseLinkTypes failed:", err)
+	}
+	if lt := cat.getByGID("bb6d5f01-4c32-4d8a-8e98-1b37e2ba2b5b"); lt == nil || lt.ID != 176 {
+		t.Errorf("getByGID returned %+v; want 176", lt)
+	}
+	if lt := cat.find("artist", "url", "purchase for download"); lt == nil || lt.ID != 176 {
+		t.Errorf("find returned %+v; want 176", lt)
+	}
+	if lt := cat.find("release", "url", "purchase for download"); lt != nil {
+		t.Errorf("find returned %+v for release; want nil", lt)
+	}
+
+	for _, tc := range []struct {
+		rel   relInfo
+		valid bool
+	}{
+		{relInfo{linkTypeID: 176, targetType: "artist", backward: true}, true},
+		{relInfo{linkTypeID: 176, targetType: "artist", backward: false}, false},
+		{relInfo{linkTypeID: 176, targetType: "release", backward: true}, false},
+		{relInfo{linkTypeID: 10, targetType: "work", backward: false}, true},
+		{relInfo{linkTypeID: 10, targetType: "work", backward: true}, false},
+		{relInfo{linkTypeID: 999, targetType: "label", backward: true}, true}, // unknown
+	} {
+		if err := cat.validate(&tc.rel, urlType); err != nil && tc.valid {
+			t.Errorf("validate(%+v) failed: %v", tc.rel, err)
+		} else if err == nil && !tc.valid {
+			t.Errorf("validate(%+v) unexpectedly succeeded", tc.rel)
+		}
+	}
+
+	if _, err := parseLinkTypes([]byte(`[{"id": 1, "name": "a", "type0": "artist", "type1": "url"},
+		{"id": 1, "name": "b", "type0": "artist", "type1": "url"}]`)); err == nil {
+		t.Error("parseLinkTypes unexpectedly accepted duplicate IDs")
+	}
+}
+
+func TestLoadLinkTypes_Dump(t *testing.T) {
+	dir := filepath.Join("testdata", "mbdump")
+	for _, p := range []string{dir, filepath.Join(dir, "link_type")} {
+		cat, err := loadLinkTypes(p)
+		if err != nil {
+			t.Errorf("loadLinkTypes(%q) failed: %v", p, err)
+			continue
+		}
+		want := linkType{ID: 176, GID: "bb6d5f01-4c32-4d8a-8e98-1b37e2ba2b5b", Name: "purchase for download",
+			Type0: "artist", Type1: "url", LinkPhrase: "can be purchased for download at", HasDates: true}
+		if lt := cat.getByGID(want.GID); lt == nil || *lt != want {
+			t.Errorf("loadLinkTypes(%q) returned %+v for %v; want %+v", p, lt, want.GID, want)
+		}
+		if lt := cat.find("artist", "url", "dateless test type"); lt == nil || lt.HasDates {
+			t.Errorf("loadLinkTypes(%q) returned %+v for dateless type", p, lt)
+		}
+	}
+}
+
+func TestLinkTypeMap(t *testing.T) {
+	m, err := newLinkTypeMap(linkTypes, urlType,
+		linkTypeMapping{
+			targets: []string{"release"},
+			dir:     dirBackward,
+			from:    []string{"free streaming", "streaming"},
+			to:      "download for free",
+		},
+		linkTypeMapping{
+			targets: []string{"artist", "release"},
+			to:      "purchase for download",
+		})
+	if err != nil {
+		t.Fatal("newLinkTypeMap failed:", err)
+	}
+	for _, tc := range []struct {
+		rel  relInfo
+		want int
+	}{
+		{relInfo{linkTypeID: 85, targetType: "release", backward: true}, 75},
+		{relInfo{linkTypeID: 980, targetType: "release", backward: true}, 75},
+		{relInfo{linkTypeID: 980, targetType: "release", backward: false}, 74}, // wrong direction for first mapping
+		{relInfo{linkTypeID: 79, targetType: "release", backward: true}, 74},
+		{relInfo{linkTypeID: 978, targetType: "artist", backward: true}, 176},
+		{relInfo{linkTypeID: 979, targetType: "recording", backward: true}, 979}, // unmapped
+	} {
+		if got := m.remap(&tc.rel); got != tc.want {
+			t.Errorf("remap(%+v) = %d; want %d", tc.rel, got, tc.want)
+		}
+	}
+
+	for _, mp := range []linkTypeMapping{
+		{targets: []string{"recording"}, to: "bogus"},
+		{targets: []string{"label"}, to: "purchase for download"},
+		{targets: []string{"artist"}, dir: dirForward, to: "purchase for download"},
+		{targets: []string{"artist"}, from: []string{"download for free"}, to: "purchase for download"},
+		{to: "purchase for download"},
+	} {
+		if _, err := newLinkTypeMap(linkTypes, urlType, mp); err == nil {
+			t.Errorf("newLinkTypeMap(%+v) unexpectedly succeeded", mp)
+		}
+	}
+}
+
+func TestRuleLinkTypeMap(t *testing.T) {
+	orig := linkTypes
+	defer func() {
+		linkTypes = orig
+		if err := rebuildLinkTypeMaps(); err != nil {
+			t.Error("Rebuilding with original link types failed:", err)
+		}
+	}()
+
+	// Maps used by rules should honor catalogs that are loaded after initialization.
+	linkTypes = mustParseLinkTypes([]byte(`[
+		{"id": 1978, "name": "streaming", "type0": "artist", "type1": "url"},
+		{"id": 1176, "name": "purchase for download", "type0": "artist", "type1": "url"},
+		{"id": 1074, "name": "purchase for download", "type0": "release", "type1": "url"},
+		{"id": 1254, "name": "purchase for download", "type0": "recording", "type1": "url"}]`))
+	if err := rebuildLinkTypeMaps(); err != nil {
+		t.Fatal("rebuildLinkTypeMaps failed:", err)
+	}
+	rel := relInfo{linkTypeID: 1978, targetType: "artist", backward: true}
+	if got := purchaseForDownloadMap.remap(&rel); got != 1176 {
+		t.Errorf("remap(%+v) = %d; want %d", rel, got, 1176)
+	}
+
+	linkTypes = mustParseLinkTypes([]byte(`[{"id": 1978, "name": "streaming", "type0": "artist", "type1": "url"}]`))
+	if err := rebuildLinkTypeMaps(); err == nil {
+		t.Error("rebuildLinkTypeMaps unexpectedly accepted catalog without types used by rules")
+	}
+}
@@ -4,37 +4,98 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 const (
-	actionCancel = "cancel" // cancel edits with IDs read from stdin
-	actionURLs   = "urls"   // update URLs corresponding to MBIDs read from stdin
+	actionCancel    = "cancel"     // cancel edits with IDs read from stdin
+	actionDiscover  = "discover"   // print MBIDs of URLs in a database dump that rules would change
+	actionNote      = "note"       // add edit notes to edits with IDs read from stdin
+	actionTestRules = "test-rules" // check URL rules against fixture files
+	actionURLs      = "urls"       // update URLs corresponding to MBIDs read from stdin
+	actionWatch     = "watch"      // continuously update URLs affected by new edits
 )
 
 var allActions = []string{
 	actionCancel,
+	actionDiscover,
+	actionNote,
+	actionTestRules,
 	actionURLs,
+	actionWatch,
 }
 
 func main() {
 	action := flag.String("action", "", "Action to perform ("+strings.Join(allActions, ", ")+")")
+	appendEditNote := flag.Bool("append-edit-note", false, "Append -edit-note to rules' edit notes instead of replacing them")
+	archive := flag.Bool("archive", false, "Reference archived snapshots of URLs in edit notes when ending relationships")
+	archiveURL := flag.String("archive-url", defaultArchiveURL, "Base URL of Wayback Machine availability API for -archive")
+	batchSize := flag.Int("batch-size", 0, "Maximum number of URLs whose relationship changes are "+
+		"combined into a single submission (0 or 1 to submit each URL's changes separately)")
+	cacheDir := flag.String("cache-dir", "", "Directory for caching fetched entities for -action="+actionURLs+" (disabled if empty)")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "Maximum age of cached entities (0 for no limit)")
+	clampDates := flag.Bool("clamp-dates", false, "Clamp end dates preceding begin dates instead of skipping relationships")
 	creds := flag.String("creds", filepath.Join(os.Getenv("HOME"), ".mbbot"), "Path to file containing username and password")
+	deferFile := flag.String("defer-file", "", "File to append MBIDs of URLs skipped by -skip-open-edits to")
 	dryRun := flag.Bool("dry-run", false, "Don't actually perform any edits")
-	editNote := flag.String("edit-note", "", "Edit note to attach to all edits")
+	dump := flag.String("dump", "", "mbdump directory or JSON lines file containing URLs for -action="+actionDiscover)
+	editNote := flag.String("edit-note", "", "Edit note to attach to all edits (template for URL edits)")
+	endDate := flag.String("end-date", "", "End date (YYYY-MM-DD) for relationships ended by generic rules")
+	exclusions := flag.String("exclusions", "", "File with additional exclusions for migration rules "+
+		"(lines containing rule name and match groups)")
+	existingURL := flag.String("existing-url", existingURLSkip, "How to handle URLs rewritten to existing URLs ("+
+		strings.Join(allExistingURLs, ", ")+"; "+existingURLMerge+" rewrites them and lets MusicBrainz merge them)")
+	fixtures := flag.String("fixtures", defaultFixtureDir, "Directory containing rule fixtures for -action="+actionTestRules+
+		"; the default only works when run from the source tree")
+	inputFormat := flag.String("input-format", inputText, "Format of input for -action="+actionURLs+" ("+
+		strings.Join(allInputFormats, ", ")+")")
+	limit := flag.Int("limit", 0, "Maximum number of input lines to process (0 for no limit)")
+	linkTypesPath := flag.String("link-types", "", "JSON file, mbdump link_type table, or mbdump directory "+
+		"containing link types (bundled snapshot used if empty)")
 	makeVotable := flag.Bool("make-votable", false, "Force voting on edits")
+	maxEdits := flag.Int("max-edits", 0, "Stop after submitting this many edits (0 for no limit)")
+	maxOpenEdits := flag.Int("max-open-edits", 0, "Maximum number of open edits for user (0 for no limit)")
+	maxRedirects := flag.Int("max-redirects", 5, "Maximum permanent redirects followed by the redirect rule")
+	openEditsWait := flag.Duration("open-edits-wait", 0, "Time to wait when -max-open-edits is reached (0 to stop)")
+	pollInterval := flag.Duration("poll-interval", 10*time.Minute, "Time between polls for -action="+actionWatch)
+	probeQPS := flag.Float64("probe-qps", defaultProbeQPS, "Maximum requests per second when probing external sites")
+	redirectHosts := flag.String("redirect-hosts", "", "Comma-separated hosts that the redirect rule may follow cross-site redirects to")
+	redirectMode := flag.String("redirect-mode", redirectRewrite, "How the redirect rule updates URLs ("+
+		strings.Join(allRedirectModes, ", ")+")")
+	refresh := flag.Bool("refresh", false, "Ignore existing entries in -cache-dir")
+	replaceExclusions := flag.Bool("replace-exclusions", false, "Replace migration rules' bundled exclusions with -exclusions")
+	report := flag.String("report", "", "File to write tab-separated report of skipped entities to")
+	resources := flag.Bool("resources", false, "Read external URLs instead of MBIDs for -action="+actionURLs)
+	rule := flag.String("rule", "", "Name of single URL rule to apply ("+strings.Join(urlRuleNames(), ", ")+")")
+	sample := flag.Int("sample", 0, "Number of input lines to randomly sample (0 to use all lines)")
 	server := flag.String("server", "https://test.musicbrainz.org", "Base URL of MusicBrainz server")
+	skipOpenEdits := flag.Bool("skip-open-edits", false, "Skip URLs that already have open edits")
+	verifyAfter := flag.Duration("verify-after", 30*time.Second, "Refetch URLs to check for concurrent edits "+
+		"if they were fetched longer ago than this before editing")
+	watchStatePath := flag.String("watch-state", filepath.Join(os.Getenv("HOME"), ".mbbot-watch.json"),
+		"JSON file used to persist state for -action="+actionWatch)
 	flag.Parse()
 
+	// journald adds its own timestamps.
+	if os.Getenv("JOURNAL_STREAM") != "" {
+		log.SetFlags(0)
+	}
+
 	if flag.NArg() != 0 {
 		fmt.Fprintln(os.Stderr, "Positional args are not accepted")
 		os.Exit(2)
@@ -47,45 +108,223 @@ func main() {
 	} else if !sliceContains(allActions, *action) {
 		fmt.Fprintf(os.Stderr, "Invalid action %q\n", *action)
 		os.Exit(2)
+	} else if *action == actionNote && *editNote == "" {
+		fmt.Fprintln(os.Stderr, "Must supply note via -edit-note")
+		os.Exit(2)
+	} else if *replaceExclusions && *exclusions == "" {
+		fmt.Fprintln(os.Stderr, "-replace-exclusions requires -exclusions")
+		os.Exit(2)
+	} else if *action == actionDiscover && *dump == "" {
+		fmt.Fprintln(os.Stderr, "Must supply database dump via -dump")
+		os.Exit(2)
+	} else if !sliceContains(allInputFormats, *inputFormat) {
+		fmt.Fprintf(os.Stderr, "Invalid -input-format value %q\n", *inputFormat)
+		os.Exit(2)
+	} else if *inputFormat != inputText && (*action != actionURLs || *resources) {
+		fmt.Fprintln(os.Stderr, "-input-format can only be used with -action="+actionURLs+" without -resources")
+		os.Exit(2)
+	} else if *deferFile != "" && !*skipOpenEdits {
+		fmt.Fprintln(os.Stderr, "-defer-file requires -skip-open-edits")
+		os.Exit(2)
+	} else if *resources && *action != actionURLs {
+		fmt.Fprintln(os.Stderr, "-resources can only be used with -action="+actionURLs)
+		os.Exit(2)
+	} else if *rule != "" && findURLRule(*rule) == nil {
+		fmt.Fprintf(os.Stderr, "Invalid rule %q\n", *rule)
+		os.Exit(2)
+	} else if !sliceContains(allExistingURLs, *existingURL) {
+		fmt.Fprintf(os.Stderr, "Invalid -existing-url value %q\n", *existingURL)
+		os.Exit(2)
+	}
+	if !sliceContains(allRedirectModes, *redirectMode) {
+		fmt.Fprintf(os.Stderr, "Invalid -redirect-mode value %q\n", *redirectMode)
+		os.Exit(2)
+	}
+	parsedEndDate, err := parseDate(*endDate)
+	if err == nil {
+		err = parsedEndDate.validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -end-date:", err)
+		os.Exit(2)
+	}
+
+	if *linkTypesPath != "" {
+		if err := useLinkTypes(*linkTypesPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed loading link types:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *exclusions != "" {
+		f, err := os.Open(*exclusions)
+		if err == nil {
+			err = loadExclusions(f, *replaceExclusions)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed loading exclusions:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Handle actions that don't require logging in.
+	if *action == actionTestRules {
+		n, errs := checkRuleFixtures(*fixtures)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Printf("%d of %d fixture(s) passed\n", n-len(errs), n)
+		if len(errs) > 0 || n == 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *action == actionDiscover {
+		n, err := discoverURLs(context.Background(), *dump, *rule, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed reading dump:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Found %d URL(s) to change\n", n)
+		os.Exit(0)
 	}
 
+	var rep *reporter
+	if *report != "" {
+		f, err := os.Create(*report)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed creating report:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		rep = newReporter(f)
+	}
+
+	var items []inputItem
+	inputType := urlType
+	if *action == actionCancel || *action == actionNote {
+		inputType = editType
+	} else if *resources {
+		inputType = resourceType
+	}
+	if *action == actionWatch {
+		// Don't read stdin.
+	} else if *inputFormat == inputText {
+		items, err = readInput(os.Stdin, inputType, rep)
+	} else {
+		items, err = readStructuredInput(os.Stdin, *inputFormat, rep)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed reading input:", err)
+		os.Exit(1)
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	items = selectItems(items, *limit, *sample, rnd)
+
 	user, pass, err := readCreds(*creds)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed reading credentials:", err)
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	log.Print("Logging in as ", user)
-	srv, err := newServer(ctx, *server, user, pass, serverDryRun(*dryRun))
+	srvOpts := []serverOption{serverDryRun(*dryRun),
+		serverMaxEdits(*maxEdits), serverMaxOpenEdits(*maxOpenEdits, *openEditsWait)}
+	if *cacheDir != "" && *action == actionURLs {
+		// URLs are always refetched before editing, so a stale cache just means
+		// that recently-changed URLs may be missed.
+		srvOpts = append(srvOpts, serverCache(*cacheDir, *cacheTTL, *refresh))
+	}
+	srv, err := newServer(ctx, *server, user, pass, srvOpts...)
 	if err != nil {
 		log.Fatal("Failed logging in: ", err)
 	}
 
+	urlOpts := urlOptions{
+		editNote:       *editNote,
+		appendEditNote: *appendEditNote,
+		makeVotable:    *makeVotable,
+		rule:           *rule,
+		existingURL:    *existingURL,
+		clampDates:     *clampDates,
+		endDate:        parsedEndDate,
+		probe:          newProber(rate.Limit(*probeQPS)),
+		redirectMode:   *redirectMode,
+		redirectHosts:  splitList(strings.ToLower(*redirectHosts)),
+		maxRedirects:   *maxRedirects,
+		report:         rep,
+		verifyAfter:    *verifyAfter,
+		skipOpenEdits:  *skipOpenEdits,
+	}
+	if *batchSize > 1 {
+		urlOpts.batch = newRelBatch(srv, *batchSize, *verifyAfter, rep)
+	}
+	if *deferFile != "" {
+		f, err := os.OpenFile(*deferFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal("Failed opening defer file: ", err)
+		}
+		defer f.Close()
+		urlOpts.deferred = f
+	}
+	if *archive {
+		urlOpts.archiveURL = *archiveURL
+	}
+
 	switch *action {
 	case actionCancel:
-		sc := bufio.NewScanner(os.Stdin)
-		for {
-			if id, err := readInt(sc); err == io.EOF {
-				break
-			} else if err != nil {
-				log.Fatal("Failed reading edit ID: ", err)
-			} else if err := cancelEdit(ctx, srv, id, *editNote); err != nil {
+		for _, item := range items {
+			id, _ := strconv.Atoi(item.id) // validated by readInput
+			if err := cancelEdit(ctx, srv, id, *editNote); err != nil {
 				log.Printf("Failed canceling edit %v: %v", id, err)
 			}
 		}
+	case actionNote:
+		for _, item := range items {
+			id, _ := strconv.Atoi(item.id) // validated by readInput
+			if err := addEditNote(ctx, srv, id, *editNote); err != nil {
+				log.Printf("Failed adding note to edit %v: %v", id, err)
+			}
+		}
 	case actionURLs:
-		sc := bufio.NewScanner(os.Stdin)
-		for {
-			if mbid, err := readMBID(sc); err == io.EOF {
+		seen := make(map[string]struct{}, len(items))
+		for _, item := range items {
+			mbid, err := resolveItem(ctx, srv, item, rep)
+			if err != nil {
+				log.Print(err)
+				continue
+			} else if _, ok := seen[mbid]; ok || mbid == "" {
+				continue
+			}
+			seen[mbid] = struct{}{}
+			opts := urlOpts
+			if item.over != nil {
+				item.over.apply(&opts)
+			}
+			if err := processURL(ctx, srv, mbid, &opts); isLimitErr(err) || ctx.Err() != nil {
+				log.Printf("Stopping at %v: %v", mbid, err)
 				break
 			} else if err != nil {
-				log.Fatal("Failed reading MBID: ", err)
-			} else if err := processURL(ctx, srv, mbid, *editNote, *makeVotable); err != nil {
 				log.Printf("Failed processing %v: %v", mbid, err)
 			}
 		}
+		if urlOpts.batch != nil {
+			if err := urlOpts.batch.flush(ctx); err != nil {
+				log.Print("Failed submitting batched relationship changes: ", err)
+			}
+		}
+	case actionWatch:
+		if err := watchURLs(ctx, srv, &watchOptions{
+			statePath: *watchStatePath,
+			interval:  *pollInterval,
+			urlOpts:   &urlOpts,
+		}); err != nil {
+			log.Fatal("Watch failed: ", err)
+		}
 	}
 }
 
@@ -102,6 +341,11 @@ func readCreds(p string) (user, pass string, err error) {
 	return parts[0], parts[1], nil
 }
 
+// isLimitErr returns true if err indicates that an edit limit enforced by server was reached.
+func isLimitErr(err error) bool {
+	return errors.Is(err, errMaxEdits) || errors.Is(err, errMaxOpenEdits)
+}
+
 // cancelEdit cancels the MusicBrainz edit with the supplied ID.
 func cancelEdit(ctx context.Context, srv *server, id int, editNote string) error {
 	log.Printf("Canceling edit %d", id)
@@ -110,3 +354,12 @@ func cancelEdit(ctx context.Context, srv *server, id int, editNote string) error
 	})
 	return err
 }
+
+// addEditNote adds a note to the MusicBrainz edit with the supplied ID.
+func addEditNote(ctx context.Context, srv *server, id int, editNote string) error {
+	log.Printf("Adding note to edit %d", id)
+	_, err := srv.post(ctx, fmt.Sprintf("/edit/%d/add-note", id), map[string]string{
+		"add-edit-note.text": editNote,
+	})
+	return err
+}
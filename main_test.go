@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,7 +14,10 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/time/rate"
@@ -33,20 +37,33 @@ type testEnv struct {
 	mux     *http.ServeMux
 	srv     *server
 
-	mbidURLs map[string]string // MBID-to-URL mappings to return
-	mbidRels map[string][]jsonRelationship
-	requests []request // POST requests sent to server
+	mbidURLs     map[string]string // MBID-to-URL mappings to return
+	mbidRels     map[string][]jsonRelationship
+	openEdits    int                     // number of open edits to report for testUser
+	snapshot     string                  // timestamp of archived snapshot to report for all URLs
+	urlEdits     map[int][]string        // edit IDs and URL MBIDs to return from edit searches
+	ownEdits     map[int]bool            // edit IDs from urlEdits that were made by testUser
+	urlOpenEdits map[string]int          // number of open edits to report for URL MBIDs
+	relResponses map[string]int          // /relationship-editor response codes keyed by relationship ID or new target MBID
+	relErrors    map[string]string       // messages for /relationship-editor to reject submissions with, keyed like relResponses
+	requests     []request               // POST requests sent to server
+	getHook      func(req *http.Request) // called before handling GET requests if non-nil
+	postStatus   func(n int) int         // returns HTTP status for nth (1-based) POST if non-nil; 0 for default
+	relResults   int                     // truncates /relationship-editor results if positive
 
 	origLogDest io.Writer
 }
 
-func newTestEnv(ctx context.Context, t *testing.T) *testEnv {
+func newTestEnv(ctx context.Context, t *testing.T, opts ...serverOption) *testEnv {
 	env := testEnv{
-		t:           t,
-		mux:         http.NewServeMux(),
-		mbidURLs:    make(map[string]string),
-		mbidRels:    make(map[string][]jsonRelationship),
-		origLogDest: log.Writer(),
+		t:            t,
+		mux:          http.NewServeMux(),
+		mbidURLs:     make(map[string]string),
+		mbidRels:     make(map[string][]jsonRelationship),
+		urlEdits:     make(map[int][]string),
+		ownEdits:     make(map[int]bool),
+		urlOpenEdits: make(map[string]int),
+		origLogDest:  log.Writer(),
 	}
 
 	// Hide spammy logs.
@@ -64,7 +81,8 @@ func newTestEnv(ctx context.Context, t *testing.T) *testEnv {
 	}()
 
 	var err error
-	env.srv, err = newServer(ctx, env.testSrv.URL, testUser, testPass, serverRateLimit(rate.Inf))
+	opts = append([]serverOption{serverRateLimit(rate.Inf)}, opts...)
+	env.srv, err = newServer(ctx, env.testSrv.URL, testUser, testPass, opts...)
 	if err != nil {
 		t.Fatal("Failed logging in:", err)
 	}
@@ -148,6 +166,9 @@ func (env *testEnv) handleDefault(w http.ResponseWriter, req *http.Request) {
 }
 
 func (env *testEnv) handleGet(w http.ResponseWriter, req *http.Request) {
+	if env.getHook != nil {
+		env.getHook(req)
+	}
 	if ms := editURLPathRegexp.FindStringSubmatch(req.URL.Path); ms != nil {
 		mbid := ms[1]
 		url, ok := env.mbidURLs[mbid]
@@ -166,6 +187,87 @@ func (env *testEnv) handleGet(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, `<script>Object.defineProperty(window,"__MB__",{value:Object.freeze({"DBDefs":Object.freeze({}),"$c":Object.freeze(`)
 		json.NewEncoder(w).Encode(data)
 		io.WriteString(w, `)})})</script></head></html>`)
+	} else if ms := openEditsPathRegexp.FindStringSubmatch(req.URL.Path); ms != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if n := env.urlOpenEdits[ms[1]]; n == 0 {
+			io.WriteString(w, `<!DOCTYPE html><html><body><p>No edits found matching your query.</p></body></html>`)
+		} else {
+			fmt.Fprintf(w, `<!DOCTYPE html><html><body><p>Found %d edits</p></body></html>`, n)
+		}
+	} else if req.URL.Path == "/ws/2/url" {
+		res := req.URL.Query().Get("resource")
+		for mbid, url := range env.mbidURLs {
+			if url == res {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(struct {
+					ID       string `json:"id"`
+					Resource string `json:"resource"`
+				}{mbid, url})
+				return
+			}
+		}
+		http.NotFound(w, req)
+	} else if req.URL.Path == "/wayback/available" {
+		// Stand in for the Wayback Machine availability API.
+		w.Header().Set("Content-Type", "application/json")
+		u := req.URL.Query().Get("url")
+		if env.snapshot == "" {
+			fmt.Fprintf(w, `{"url":%q,"archived_snapshots":{}}`, u)
+			return
+		}
+		fmt.Fprintf(w, `{"url":%q,"archived_snapshots":{"closest":`+
+			`{"status":"200","available":true,"url":"http://web.archive.org/web/%s/%s","timestamp":%q}}}`,
+			u, env.snapshot, u, env.snapshot)
+	} else if req.URL.Path == "/search/edits" {
+		// Write a minimal results page listing edits in the requested order.
+		// Only the "editor" (not_me) and "id" (>) conditions are honored.
+		q := req.URL.Query()
+		notMe, minID := false, 0
+		for i := 0; q.Get(fmt.Sprintf("conditions.%d.field", i)) != ""; i++ {
+			pre := fmt.Sprintf("conditions.%d.", i)
+			switch q.Get(pre + "field") {
+			case "editor":
+				notMe = q.Get(pre+"operator") == "not_me"
+			case "id":
+				if q.Get(pre+"operator") == ">" {
+					minID, _ = strconv.Atoi(q.Get(pre + "args.0"))
+					minID++
+				}
+			}
+		}
+		var ids []int
+		for id := range env.urlEdits {
+			if id >= minID && !(notMe && env.ownEdits[id]) {
+				ids = append(ids, id)
+			}
+		}
+		if q.Get("order") == "asc" {
+			sort.Ints(ids)
+		} else {
+			sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+		}
+		page, _ := strconv.Atoi(q.Get("page"))
+		start := (page - 1) * testEditSearchPageSize
+		if start < 0 || start > len(ids) {
+			start = len(ids)
+		}
+		end := start + testEditSearchPageSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, `<!DOCTYPE html><html><body>`)
+		for _, id := range ids[start:end] {
+			fmt.Fprintf(w, `<div class="edit-list"><h2><a href="%s/edit/%d">Edit #%d</a></h2>`, env.testSrv.URL, id, id)
+			for _, mbid := range env.urlEdits[id] {
+				fmt.Fprintf(w, `<a href="%s/url/%s">URL</a>`, env.testSrv.URL, mbid)
+			}
+			io.WriteString(w, `</div>`)
+		}
+		io.WriteString(w, `</body></html>`)
+	} else if req.URL.Path == "/user/"+testUser+"/edits/open" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!DOCTYPE html><html><body><p>Found %d edits</p></body></html>`, env.openEdits)
 	} else {
 		http.NotFound(w, req)
 	}
@@ -183,8 +285,15 @@ func (env *testEnv) handlePost(w http.ResponseWriter, req *http.Request) {
 	u.Host = ""
 	env.requests = append(env.requests, request{u.String(), req.PostForm})
 
+	if env.postStatus != nil {
+		if code := env.postStatus(len(env.requests)); code != 0 {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+	}
+
 	switch {
-	case cancelEditPathRegexp.MatchString(req.URL.Path):
+	case cancelEditPathRegexp.MatchString(req.URL.Path), addNotePathRegexp.MatchString(req.URL.Path):
 		// TODO: Maybe return something here? The bot doesn't check the response.
 	case editURLPathRegexp.MatchString(req.URL.Path):
 		// Write a simple page containing an arbitrary edit ID.
@@ -197,20 +306,61 @@ func (env *testEnv) handlePost(w http.ResponseWriter, req *http.Request) {
   </body>
 </html>`, env.testSrv.URL)
 	case req.URL.Path == "/relationship-editor":
-		// Just write a bogus JSON object reporting one successful edit.
+		// Write a bogus JSON object reporting an edit for each relationship.
+		vals := flattenValues(req.PostForm)
+		edits := make([]relEditResult, countRelEdits(vals))
+		for i := range edits {
+			pre := fmt.Sprintf("%s%d.", relEditPrefix, i)
+			id := vals[pre+"id"]
+			if id == "" {
+				id = vals[pre+"entity.0.gid"] + vals[pre+"entity.1.gid"] // URLs don't have GIDs
+			}
+			if msg, ok := env.relErrors[id]; ok {
+				// The whole submission is rejected in this case.
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(struct {
+					Error string `json:"error"`
+				}{msg})
+				return
+			}
+			edits[i] = relEditResult{EditType: 1, Response: relEditResponseOK}
+			if code, ok := env.relResponses[id]; ok {
+				edits[i].Response = code
+			}
+		}
+		if env.relResults > 0 && env.relResults < len(edits) {
+			edits = edits[:env.relResults]
+		}
 		w.Header().Set("Content-Type", "application/json")
-		io.WriteString(w, `{"edits":[{"edit_type":1,"response":1}]}`)
+		json.NewEncoder(w).Encode(struct {
+			Edits []relEditResult `json:"edits"`
+		}{edits})
 	default:
 		env.t.Errorf("Unexpected post to %v", req.URL.Path)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 }
 
+// testEditSearchPageSize is the number of edits returned per page by edit searches.
+const testEditSearchPageSize = 2
+
 var (
 	cancelEditPathRegexp = regexp.MustCompile(`^/edit/\d+/cancel$`)
+	addNotePathRegexp    = regexp.MustCompile(`^/edit/\d+/add-note$`)
 	editURLPathRegexp    = regexp.MustCompile(`^/url/([^/]+)/edit$`)
+	openEditsPathRegexp  = regexp.MustCompile(`^/url/([^/]+)/open_edits$`)
 )
 
+// flattenValues returns a map containing the first value for each key in vals.
+func flattenValues(vals url.Values) map[string]string {
+	m := make(map[string]string, len(vals))
+	for k := range vals {
+		m[k] = vals.Get(k)
+	}
+	return m
+}
+
 // request describes a request that was posted to the server.
 type request struct {
 	path   string
@@ -239,3 +389,71 @@ func TestCancelEdit(t *testing.T) {
 		t.Error("Bad requests:\n" + diff)
 	}
 }
+
+func TestAddEditNote(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const editNote = "the old URL 404s; see the ticket for details"
+	for _, id := range []int{123, 456} {
+		if err := addEditNote(ctx, env.srv, id, editNote); err != nil {
+			t.Fatalf("addEditNote(ctx, srv, %d, %q) failed: %v", id, editNote, err)
+		}
+	}
+	var want []request
+	for _, id := range []int{123, 456} {
+		want = append(want, request{
+			path:   fmt.Sprintf("/edit/%d/add-note", id),
+			params: url.Values{"add-edit-note.text": []string{editNote}},
+		})
+	}
+	if diff := cmp.Diff(want, env.requests, cmp.AllowUnexported(request{})); diff != "" {
+		t.Error("Bad requests:\n" + diff)
+	}
+}
+
+func TestServer_PostEdit_Limits(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t, serverMaxEdits(3), serverMaxOpenEdits(10, 0))
+	defer env.close()
+
+	const path = "/url/8e6ad8e8-7a1a-4a14-8dc1-70e6b7b61e4b/edit"
+	for _, tc := range []struct {
+		n, openEdits int
+		want         error
+	}{
+		{1, 0, nil},
+		{1, 10, errMaxOpenEdits},
+		{1, 9, nil},
+		{2, 0, errMaxEdits},
+		{1, 0, nil},
+		{1, 0, errMaxEdits},
+	} {
+		env.openEdits = tc.openEdits
+		if _, err := env.srv.postEdit(ctx, path, nil, tc.n); err != tc.want {
+			t.Errorf("postEdit(ctx, %q, nil, %d) with %d open edit(s) returned %v; want %v",
+				path, tc.n, tc.openEdits, err, tc.want)
+		}
+	}
+	if got, want := len(env.requests), 3; got != want {
+		t.Errorf("Got %d request(s); want %d", got, want)
+	}
+}
+
+func TestServer_PostEdit_WaitForOpenEdits(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t, serverMaxOpenEdits(10, time.Millisecond))
+	defer env.close()
+
+	// The wait should time out since the open edit count never drops.
+	env.openEdits = 20
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := env.srv.postEdit(ctx, "/relationship-editor", nil, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("postEdit with too many open edits returned %v; want %v", err, context.DeadlineExceeded)
+	}
+	if len(env.requests) != 0 {
+		t.Errorf("Got %d request(s); want 0", len(env.requests))
+	}
+}
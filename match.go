@@ -0,0 +1,55 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+// Values for relMatcher.ended.
+const (
+	matchAnyEnded = iota // match both ended and unended relationships
+	matchEnded           // only match ended relationships
+	matchUnended         // only match unended relationships
+)
+
+// relMatcher describes conditions on the relationships attached to an entity.
+// It lets rules resolve ambiguous URLs based on what they're attached to.
+// The zero value matches any entity with at least one relationship.
+type relMatcher struct {
+	targets   []string // target entity types, e.g. "recording"; empty for any
+	linkTypes []string // link type names, e.g. "free streaming"; empty for any
+	ended     int      // match* value
+	min       int      // minimum number of matching target entities; 0 is treated as 1
+	max       int      // maximum number of matching target entities; 0 for no limit
+}
+
+// filter returns the relationships in rels that satisfy m's per-relationship conditions.
+func (m *relMatcher) filter(rels []relInfo) []relInfo {
+	var filtered []relInfo
+	for _, rel := range rels {
+		if len(m.targets) > 0 && !sliceContains(m.targets, rel.targetType) {
+			continue
+		}
+		if len(m.linkTypes) > 0 {
+			if lt := linkTypes.get(rel.linkTypeID); lt == nil || !sliceContains(m.linkTypes, lt.Name) {
+				continue
+			}
+		}
+		if (m.ended == matchEnded && !rel.ended) || (m.ended == matchUnended && rel.ended) {
+			continue
+		}
+		filtered = append(filtered, rel)
+	}
+	return filtered
+}
+
+// match returns true if rels satisfy all of m's conditions.
+func (m *relMatcher) match(rels []relInfo) bool {
+	targets := make(map[string]struct{})
+	for _, rel := range m.filter(rels) {
+		targets[rel.targetType+"/"+rel.targetMBID] = struct{}{}
+	}
+	min := m.min
+	if min == 0 {
+		min = 1
+	}
+	return len(targets) >= min && (m.max == 0 || len(targets) <= m.max)
+}
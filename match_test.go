@@ -0,0 +1,35 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import "testing"
+
+func TestRelMatcher(t *testing.T) {
+	rels := []relInfo{
+		{targetType: "recording", targetMBID: "a", linkTypeID: 268},
+		{targetType: "recording", targetMBID: "a", linkTypeID: 254, ended: true},
+		{targetType: "recording", targetMBID: "b", linkTypeID: 979},
+		{targetType: "release", targetMBID: "c", linkTypeID: 980, ended: true},
+	}
+	for _, tc := range []struct {
+		m    relMatcher
+		want bool
+	}{
+		{relMatcher{}, true},
+		{relMatcher{targets: []string{"artist"}}, false},
+		{relMatcher{targets: []string{"release"}}, true},
+		{relMatcher{targets: []string{"release"}, ended: matchUnended}, false},
+		{relMatcher{targets: []string{"recording"}, min: 2}, true},
+		{relMatcher{targets: []string{"recording"}, min: 3}, false},
+		{relMatcher{targets: []string{"recording"}, max: 1}, false},
+		{relMatcher{targets: []string{"recording"}, ended: matchEnded, max: 1}, true},
+		{relMatcher{linkTypes: []string{"streaming"}, min: 2, max: 2}, true},
+		{relMatcher{linkTypes: []string{"free streaming", "purchase for download"}, max: 1}, true},
+		{relMatcher{linkTypes: []string{"download for free"}}, false},
+	} {
+		if got := tc.m.match(rels); got != tc.want {
+			t.Errorf("%+v matched %v; want %v", tc.m, got, tc.want)
+		}
+	}
+}
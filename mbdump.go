@@ -0,0 +1,61 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// copyNull is used to represent NULL values in PostgreSQL COPY output.
+const copyNull = `\N`
+
+// readCopyFile reads PostgreSQL COPY text-format output from the file at p and
+// passes each row's unescaped values to fn. An error is returned if a row doesn't
+// contain exactly ncols values.
+func readCopyFile(p string, ncols int, fn func(row []string) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for ln := 1; sc.Scan(); ln++ {
+		row := strings.Split(sc.Text(), "\t")
+		if len(row) != ncols {
+			return fmt.Errorf("%v:%d: got %d column(s); want %d", p, ln, len(row), ncols)
+		}
+		for i, s := range row {
+			row[i] = unescapeCopy(s)
+		}
+		if err := fn(row); err != nil {
+			return fmt.Errorf("%v:%d: %v", p, ln, err)
+		}
+	}
+	return sc.Err()
+}
+
+// copyUnescaper replaces backslash escape sequences in COPY output.
+var copyUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+
+// unescapeCopy unescapes a single value from COPY output. copyNull is returned unchanged.
+func unescapeCopy(s string) string {
+	if s == copyNull || !strings.Contains(s, `\`) {
+		return s
+	}
+	return copyUnescaper.Replace(s)
+}
+
+// copyInt parses an integer value from COPY output. NULL is returned as 0.
+func copyInt(s string) (int, error) {
+	if s == copyNull {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
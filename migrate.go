@@ -0,0 +1,137 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// urlMigration describes how URLs matched by a rule's regular expression are migrated to new URLs.
+// Relationships to the original URL are ended at date, and copies of the relationships beginning
+// at date are added to the new URL.
+type urlMigration struct {
+	target      string              // new URL template, e.g. "https://example.org/$1/$2"; see regexp.Expand
+	date        date                // handoff date
+	editNote    string              // edit note for rule's edits
+	exclude     map[string]struct{} // space-joined match groups for which no new URL is created
+	copyAttrs   bool                // copy relationships' attributes to the new URL
+	copyCredits bool                // copy relationships' target credits to the new URL
+}
+
+// migrationExclusions contains the exclusions used by each rule created by migrationRule,
+// keyed by rule name. The maps are shared with the rules so they can be updated by loadExclusions.
+var migrationExclusions = make(map[string]map[string]struct{})
+
+// migrationRule returns a urlRule named name that uses m to migrate URLs matched by re.
+func migrationRule(name string, re *regexp.Regexp, m urlMigration) urlRule {
+	if m.exclude == nil {
+		m.exclude = make(map[string]struct{})
+	}
+	migrationExclusions[name] = m.exclude
+	return urlRule{name: name, re: re, fn: func(orig *entityInfo, ms []string) *urlResult {
+		if len(orig.rels) == 0 {
+			return nil
+		}
+		res := urlResult{
+			rewritten: orig.name, // leave the URL alone
+			editNote:  m.editNote,
+		}
+		var newURL string
+		if _, ok := m.exclude[strings.Join(ms[1:], " ")]; !ok {
+			newURL = string(re.ExpandString(nil, m.target, orig.name, re.FindStringSubmatchIndex(orig.name)))
+		}
+		n := len(res.newURLs)
+		handOffRels(orig, newURL, m.date, &res)
+		for i := n; i < len(res.newURLs); i++ {
+			for j := range res.newURLs[i].rels {
+				rel := &res.newURLs[i].rels[j]
+				if !m.copyAttrs {
+					rel.attrs = ""
+				}
+				if !m.copyCredits {
+					rel.targetCred = ""
+				}
+			}
+		}
+		return &res
+	}}
+}
+
+// parseExclusions parses a list of urlMigration exclusions from r.
+// Each line contains whitespace-separated values corresponding to a rule's match groups.
+// Blank lines and lines starting with '#' are ignored.
+func parseExclusions(r io.Reader) (map[string]struct{}, error) {
+	ex := make(map[string]struct{})
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ex[strings.Join(strings.Fields(line), " ")] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// loadExclusions reads additional exclusions for rules created by migrationRule from r.
+// Each line contains a rule name followed by whitespace-separated values corresponding to
+// the rule's match groups. Blank lines and lines starting with '#' are ignored.
+// If replace is true, the rules' existing (e.g. bundled) exclusions are discarded first.
+func loadExclusions(r io.Reader, replace bool) error {
+	loaded := make(map[string][]string)
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d: want rule name and values", ln)
+		} else if _, ok := migrationExclusions[fields[0]]; !ok {
+			return fmt.Errorf("line %d: unknown migration rule %q", ln, fields[0])
+		}
+		loaded[fields[0]] = append(loaded[fields[0]], strings.Join(fields[1:], " "))
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	if replace {
+		for _, ex := range migrationExclusions {
+			for k := range ex {
+				delete(ex, k)
+			}
+		}
+	}
+	for name, keys := range loaded {
+		for _, k := range keys {
+			migrationExclusions[name][k] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// mustParseExclusions calls parseExclusions and panics on error.
+func mustParseExclusions(s string) map[string]struct{} {
+	ex, err := parseExclusions(strings.NewReader(s))
+	if err != nil {
+		panic(fmt.Sprintf("Failed parsing exclusions: %v", err))
+	}
+	return ex
+}
+
+// recmusicExclusions contains [type, id] pairs for recmusic.jp URLs that don't work after
+// rewriting to music.tower.jp.
+//
+//go:embed data/recmusic_exclusions.txt
+var recmusicExclusions string
@@ -0,0 +1,117 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMigrationRule(t *testing.T) {
+	d := date{2021, 10, 1}
+	re := regexp.MustCompile(`^https://old\.example/(a|b)/(\d+)$`)
+	mig := urlMigration{
+		target:  "https://new.example/$2/$1",
+		date:    d,
+		exclude: mustParseExclusions("# comment\n\nb  2\n"),
+	}
+	rels := []relInfo{
+		{id: 1, targetMBID: "x", attrs: "attr", targetCred: "X"},
+		{id: 2, targetMBID: "y", ended: true, endDate: date{2003, 0, 0}},
+	}
+
+	for _, tc := range []struct {
+		url         string
+		copy        bool // urlMigration.copyAttrs and copyCredits
+		wantNewURL  string
+		wantNewRels []relInfo
+	}{
+		{"https://old.example/a/1", false, "https://new.example/1/a", []relInfo{
+			{targetMBID: "x", beginDate: d},
+			{targetMBID: "y", beginDate: d},
+		}},
+		{"https://old.example/a/1", true, "https://new.example/1/a", []relInfo{
+			{targetMBID: "x", beginDate: d, attrs: "attr", targetCred: "X"},
+			{targetMBID: "y", beginDate: d},
+		}},
+		{"https://old.example/b/2", false, "", nil}, // excluded
+	} {
+		m := mig
+		m.copyAttrs, m.copyCredits = tc.copy, tc.copy
+		rule := migrationRule("test", re, m)
+		orig := entityInfo{name: tc.url, typ: urlType, rels: rels}
+		res := rule.fn(&orig, re.FindStringSubmatch(tc.url))
+		if res == nil {
+			t.Errorf("%v (copy=%v) not migrated", tc.url, tc.copy)
+			continue
+		}
+		if want := []relInfo{{id: 1, targetMBID: "x", attrs: "attr", targetCred: "X", ended: true, endDate: d}}; !reflect.DeepEqual(res.updatedRels, want) {
+			t.Errorf("%v (copy=%v) updated %v; want %v", tc.url, tc.copy, res.updatedRels, want)
+		}
+		var gotURL string
+		var gotRels []relInfo
+		if len(res.newURLs) > 0 {
+			gotURL, gotRels = res.newURLs[0].name, res.newURLs[0].rels
+		}
+		if gotURL != tc.wantNewURL || !reflect.DeepEqual(gotRels, tc.wantNewRels) {
+			t.Errorf("%v (copy=%v) added %q with %v; want %q with %v",
+				tc.url, tc.copy, gotURL, gotRels, tc.wantNewURL, tc.wantNewRels)
+		}
+	}
+}
+
+func TestParseExclusions(t *testing.T) {
+	got, err := parseExclusions(strings.NewReader("# comment\nartist 123\n\n  album\t456 \n"))
+	if err != nil {
+		t.Fatal("parseExclusions failed: ", err)
+	}
+	want := map[string]struct{}{"artist 123": {}, "album 456": {}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseExclusions returned %v; want %v", got, want)
+	}
+}
+
+func TestLoadExclusions(t *testing.T) {
+	const name = "load-test"
+	re := regexp.MustCompile(`^https://old\.example/(a|b)/(\d+)$`)
+	migrationRule(name, re, urlMigration{exclude: mustParseExclusions("a 1\n")})
+	saved := make(map[string]map[string]struct{}, len(migrationExclusions))
+	for n, ex := range migrationExclusions {
+		saved[n] = make(map[string]struct{}, len(ex))
+		for k := range ex {
+			saved[n][k] = struct{}{}
+		}
+	}
+	defer func() {
+		for n, ex := range saved {
+			for k := range ex {
+				migrationExclusions[n][k] = struct{}{}
+			}
+		}
+		delete(migrationExclusions, name)
+	}()
+
+	for _, tc := range []struct {
+		data    string
+		replace bool
+		want    map[string]struct{}
+	}{
+		{"# comment\n\n" + name + "  b 2\n", false, map[string]struct{}{"a 1": {}, "b 2": {}}},
+		{name + " b 3\n", true, map[string]struct{}{"b 3": {}}},
+	} {
+		if err := loadExclusions(strings.NewReader(tc.data), tc.replace); err != nil {
+			t.Errorf("loadExclusions(%q, %v) failed: %v", tc.data, tc.replace, err)
+		} else if got := migrationExclusions[name]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("loadExclusions(%q, %v) produced %v; want %v", tc.data, tc.replace, got, tc.want)
+		}
+	}
+
+	for _, data := range []string{"bogus-rule a 1\n", name + "\n"} {
+		if err := loadExclusions(strings.NewReader(data), false); err == nil {
+			t.Errorf("loadExclusions(%q, false) unexpectedly succeeded", data)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+// Package normalize canonicalizes URLs in the manner of MusicBrainz's URL cleanup.
+package normalize
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// URL returns the canonical form of u.
+//
+// Generic steps are applied to all URLs: the scheme and hostname are lowercased,
+// default ports are dropped, and tracking parameters are removed from the query.
+// URLs belonging to known sites additionally have their scheme upgraded to HTTPS,
+// their hostname replaced by the site's canonical hostname (stripping prefixes
+// like "www.", "m.", and locale subdomains), and their path, query, fragment,
+// and trailing slash rewritten to the site's canonical form.
+func URL(u string) (string, error) {
+	pu, err := url.Parse(strings.TrimSpace(u))
+	if err != nil {
+		return "", err
+	}
+	if pu.Scheme != "http" && pu.Scheme != "https" { // Parse lowercases the scheme
+		return "", fmt.Errorf("unsupported scheme %q", pu.Scheme)
+	}
+	if pu.Host == "" || pu.Opaque != "" || pu.User != nil {
+		return "", fmt.Errorf("unsupported URL %q", u)
+	}
+
+	pu.Host = strings.ToLower(pu.Host)
+	if port := pu.Port(); (pu.Scheme == "http" && port == "80") || (pu.Scheme == "https" && port == "443") {
+		pu.Host = pu.Hostname()
+	}
+	pu.Host = strings.TrimSuffix(pu.Host, ".")
+	removeTrackingParams(pu)
+
+	for _, s := range sites {
+		if ms := s.host.FindStringSubmatch(pu.Host); ms != nil {
+			s.apply(pu, ms)
+			break
+		}
+	}
+	return pu.String(), nil
+}
+
+// trackingParamRegexp matches query parameters that are used for tracking
+// and never affect the content of a page.
+var trackingParamRegexp = regexp.MustCompile(
+	`^(?:utm_[a-z]+|fbclid|gclid|dclid|msclkid|igshid|mc_cid|mc_eid|_ga|_gl|yclid)$`)
+
+// removeTrackingParams removes tracking parameters from pu's query.
+func removeTrackingParams(pu *url.URL) {
+	if pu.RawQuery == "" {
+		pu.ForceQuery = false
+		return
+	}
+	// Operate on the raw query to avoid reordering or reencoding the remaining parameters.
+	var kept []string
+	for _, p := range strings.Split(pu.RawQuery, "&") {
+		if p == "" {
+			continue
+		}
+		name := p
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			name = p[:i]
+		}
+		if !trackingParamRegexp.MatchString(strings.ToLower(name)) {
+			kept = append(kept, p)
+		}
+	}
+	pu.RawQuery = strings.Join(kept, "&")
+}
+
+// site describes how to canonicalize URLs belonging to a website.
+type site struct {
+	host *regexp.Regexp // matched against lowercase hostname
+	// canonHost is the canonical hostname. It may contain "$1" etc. to refer to groups from host.
+	// If empty, the original hostname is preserved.
+	canonHost string
+	// paths are tried in order against the URL path. The first match's replacement
+	// (which may contain "$1" etc.) is used as the new path, and the remaining paths are skipped.
+	paths []pathRewrite
+	// query lists query parameters that are preserved. All others are dropped.
+	// If nil, all parameters are preserved.
+	query []string
+	// keepFragment preserves the URL's fragment.
+	keepFragment bool
+	// trailingSlash adds a trailing slash to the path if true and removes it if false.
+	// Root paths are always "/".
+	trailingSlash bool
+	// fn is optionally called after all other steps.
+	fn func(pu *url.URL)
+}
+
+type pathRewrite struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// apply canonicalizes pu, whose hostname was matched by s.host with submatches ms.
+func (s *site) apply(pu *url.URL, ms []string) {
+	pu.Scheme = "https"
+	if s.canonHost != "" {
+		pu.Host = expand(s.canonHost, ms)
+	}
+
+	origPath := pu.Path
+	for _, pr := range s.paths {
+		if pms := pr.re.FindStringSubmatch(pu.Path); pms != nil {
+			pu.Path = expand(pr.repl, pms)
+			break
+		}
+	}
+	if pu.Path == "" || pu.Path == "/" {
+		pu.Path = "/"
+	} else if s.trailingSlash && !strings.HasSuffix(pu.Path, "/") {
+		pu.Path += "/"
+	} else if !s.trailingSlash {
+		pu.Path = strings.TrimRight(pu.Path, "/")
+	}
+	if pu.Path != origPath {
+		pu.RawPath = ""
+	}
+
+	if s.query != nil {
+		q := pu.Query()
+		kept := make(url.Values)
+		for _, k := range s.query {
+			if v, ok := q[k]; ok {
+				kept[k] = v
+			}
+		}
+		pu.RawQuery = kept.Encode()
+	}
+	pu.ForceQuery = false
+	if !s.keepFragment {
+		pu.Fragment = ""
+		pu.RawFragment = ""
+	}
+
+	if s.fn != nil {
+		s.fn(pu)
+	}
+}
+
+// expand replaces "$1" etc. in tmpl with the corresponding elements of ms.
+func expand(tmpl string, ms []string) string {
+	for i := len(ms) - 1; i >= 1; i-- {
+		tmpl = strings.ReplaceAll(tmpl, fmt.Sprintf("$%d", i), ms[i])
+	}
+	return tmpl
+}
+
+// noQuery can be used as site.query to drop all query parameters.
+var noQuery = []string{}
+
+// sites lists websites with known canonical URL forms.
+var sites = []*site{
+	{
+		// https://open.spotify.com/intl-de/album/6TUkoJnKYbVZWLwzxyqHLA?si=abc
+		//  -> https://open.spotify.com/album/6TUkoJnKYbVZWLwzxyqHLA
+		host:      regexp.MustCompile(`^(?:open|play|www)\.spotify\.com$`),
+		canonHost: "open.spotify.com",
+		paths: []pathRewrite{{
+			regexp.MustCompile(`^(?:/embed)?(?:/intl-[a-z]{2}(?:-[a-z]{2})?)?` +
+				`/(artist|album|track|playlist|show|episode)/([A-Za-z0-9]{22})(?:/.*)?$`),
+			"/$1/$2",
+		}},
+		query: noQuery,
+	},
+	{
+		// https://www.deezer.com/fr/album/302127 -> https://www.deezer.com/album/302127
+		host:      regexp.MustCompile(`^(?:www\.)?deezer\.com$`),
+		canonHost: "www.deezer.com",
+		paths: []pathRewrite{{
+			regexp.MustCompile(`^(?:/[a-z]{2})?/(artist|album|track|playlist)/(\d+)(?:/.*)?$`),
+			"/$1/$2",
+		}},
+		query: noQuery,
+	},
+	{
+		// https://music.apple.com/gb/album/some-title/1440857781?uo=4
+		//  -> https://music.apple.com/gb/album/1440857781
+		// https://itunes.apple.com/album/id1440857781 -> https://music.apple.com/us/album/1440857781
+		host:      regexp.MustCompile(`^(?:geo\.)?(?:music|itunes)\.apple\.com$`),
+		canonHost: "music.apple.com",
+		paths: []pathRewrite{
+			{
+				regexp.MustCompile(`^/([a-z]{2})/(artist|album|music-video|song)/(?:[^/]+/)?(?:id)?(\d+)/?$`),
+				"/$1/$2/$3",
+			},
+			{
+				regexp.MustCompile(`^/(artist|album|music-video|song)/(?:[^/]+/)?(?:id)?(\d+)/?$`),
+				"/us/$1/$2",
+			},
+		},
+		query: noQuery,
+	},
+	{
+		// https://m.soundcloud.com/artist/ -> https://soundcloud.com/artist
+		host:      regexp.MustCompile(`^(?:www\.|m\.)?soundcloud\.com$`),
+		canonHost: "soundcloud.com",
+		query:     noQuery,
+	},
+	{
+		// https://m.youtube.com/watch?v=dQw4w9WgXcQ&feature=share
+		//  -> https://www.youtube.com/watch?v=dQw4w9WgXcQ
+		host:      regexp.MustCompile(`^(?:www\.|m\.)?youtube\.com$`),
+		canonHost: "www.youtube.com",
+		query:     []string{"v", "list"},
+	},
+	{
+		// YouTube Music is a separate site with its own link types.
+		// https://music.youtube.com/watch?v=dQw4w9WgXcQ&feature=share
+		//  -> https://music.youtube.com/watch?v=dQw4w9WgXcQ
+		host:      regexp.MustCompile(`^music\.youtube\.com$`),
+		canonHost: "music.youtube.com",
+		query:     []string{"v", "list"},
+	},
+	{
+		// https://youtu.be/dQw4w9WgXcQ -> https://www.youtube.com/watch?v=dQw4w9WgXcQ
+		host:  regexp.MustCompile(`^youtu\.be$`),
+		query: noQuery,
+		fn: func(pu *url.URL) {
+			if id := strings.Trim(pu.Path, "/"); id != "" && !strings.Contains(id, "/") {
+				pu.Host = "www.youtube.com"
+				pu.Path = "/watch"
+				pu.RawQuery = url.Values{"v": []string{id}}.Encode()
+			}
+		},
+	},
+	{
+		// http://artist.bandcamp.com/album/title?from=search -> https://artist.bandcamp.com/album/title
+		host:  regexp.MustCompile(`^[a-z0-9-]+\.bandcamp\.com$`),
+		query: noQuery,
+	},
+	{
+		// https://www.discogs.com/de/artist/12345-Some-Artist -> https://www.discogs.com/artist/12345
+		host:      regexp.MustCompile(`^(?:www\.|m\.)?discogs\.com$`),
+		canonHost: "www.discogs.com",
+		paths: []pathRewrite{{
+			regexp.MustCompile(`^(?:/[a-z]{2})?(?:/[^/]+)?/(artist|release|master|label)/(\d+)(?:-[^/]*)?/?$`),
+			"/$1/$2",
+		}},
+		query: noQuery,
+	},
+	{
+		// https://amazon.co.jp/Some-Title/dp/B000002UAL/ref=sr_1_1 -> https://www.amazon.co.jp/gp/product/B000002UAL
+		host:      regexp.MustCompile(`^(?:www\.)?amazon\.(com|ca|com\.mx|com\.br|co\.uk|de|fr|it|es|nl|co\.jp|com\.au|in)$`),
+		canonHost: "www.amazon.$1",
+		paths: []pathRewrite{{
+			regexp.MustCompile(`^(?:/[^/]+)?/(?:dp|gp/product|exec/obidos/ASIN)/([A-Z0-9]{10})(?:[/?].*)?$`),
+			"/gp/product/$1",
+		}},
+		query: noQuery,
+	},
+	{
+		// https://beatport.com/release/some-title/12345/ -> https://www.beatport.com/release/some-title/12345
+		host:      regexp.MustCompile(`^(?:www\.|classic\.)?beatport\.com$`),
+		canonHost: "www.beatport.com",
+		paths: []pathRewrite{{
+			regexp.MustCompile(`^(?:/[a-z]{2})?/(artist|release|track|label|chart)/([^/]+)/(\d+)/?$`),
+			"/$1/$2/$3",
+		}},
+		query: noQuery,
+	},
+	{
+		// https://de-de.facebook.com/someartist/?ref=page_internal -> https://www.facebook.com/someartist
+		host:      regexp.MustCompile(`^(?:www\.|m\.|mobile\.|[a-z]{2}-[a-z]{2}\.|[a-z]{2}\.)?facebook\.com$`),
+		canonHost: "www.facebook.com",
+		query:     []string{"id"},
+	},
+}
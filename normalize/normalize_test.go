@@ -0,0 +1,76 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package normalize
+
+import "testing"
+
+func TestURL(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		// Generic steps.
+		{"https://www.example.org/", "https://www.example.org/"},
+		{"http://www.example.org/a/b/", "http://www.example.org/a/b/"},
+		{"HTTP://WWW.Example.ORG:80/Path", "http://www.example.org/Path"},
+		{"https://example.org:443/?utm_source=x&id=3&fbclid=abc", "https://example.org/?id=3"},
+		{"https://example.org/page?utm_medium=y", "https://example.org/page"},
+		{"https://example.org/a%2Fb?q=1#frag", "https://example.org/a%2Fb?q=1#frag"},
+
+		// Spotify
+		{"http://open.spotify.com/intl-de/album/6TUkoJnKYbVZWLwzxyqHLA?si=abc",
+			"https://open.spotify.com/album/6TUkoJnKYbVZWLwzxyqHLA"},
+		{"https://play.spotify.com/artist/0OdUWJ0sBjDrqHygGUXeCF/", "https://open.spotify.com/artist/0OdUWJ0sBjDrqHygGUXeCF"},
+		{"https://open.spotify.com/embed/track/4uLU6hMCjMI75M1A2tKUQC", "https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC"},
+
+		// Deezer
+		{"http://deezer.com/fr/album/302127", "https://www.deezer.com/album/302127"},
+		{"https://www.deezer.com/en/artist/27?app_id=1", "https://www.deezer.com/artist/27"},
+
+		// Apple Music
+		{"https://music.apple.com/gb/album/some-title/1440857781?uo=4", "https://music.apple.com/gb/album/1440857781"},
+		{"https://itunes.apple.com/us/artist/some-artist/id909253", "https://music.apple.com/us/artist/909253"},
+		{"https://itunes.apple.com/album/id1440857781", "https://music.apple.com/us/album/1440857781"},
+
+		// SoundCloud
+		{"http://m.soundcloud.com/artist/", "https://soundcloud.com/artist"},
+		{"https://www.soundcloud.com/artist/track?in=x", "https://soundcloud.com/artist/track"},
+
+		// YouTube
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ&feature=share", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"http://youtu.be/dQw4w9WgXcQ?t=10", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://youtube.com/channel/UC38IQsAvIsxxjztdMZQtwHA/", "https://www.youtube.com/channel/UC38IQsAvIsxxjztdMZQtwHA"},
+		{"http://music.youtube.com/playlist?list=OLAK5uy_abc&si=xyz", "https://music.youtube.com/playlist?list=OLAK5uy_abc"},
+
+		// Bandcamp
+		{"http://artist.bandcamp.com", "https://artist.bandcamp.com/"},
+		{"http://artist.bandcamp.com/album/title?from=search", "https://artist.bandcamp.com/album/title"},
+
+		// Discogs
+		{"https://www.discogs.com/de/artist/12345-Some-Artist", "https://www.discogs.com/artist/12345"},
+		{"http://discogs.com/Some-Artist-Some-Title/release/678", "https://www.discogs.com/release/678"},
+
+		// Amazon
+		{"http://amazon.co.jp/Some-Title/dp/B000002UAL/ref=sr_1_1?ie=UTF8", "https://www.amazon.co.jp/gp/product/B000002UAL"},
+		{"https://www.amazon.com/gp/product/B000002UAL", "https://www.amazon.com/gp/product/B000002UAL"},
+
+		// Beatport
+		{"https://beatport.com/release/some-title/12345/", "https://www.beatport.com/release/some-title/12345"},
+
+		// Facebook
+		{"https://de-de.facebook.com/someartist/?ref=page_internal", "https://www.facebook.com/someartist"},
+		{"http://m.facebook.com/profile.php?id=1234&ref=x", "https://www.facebook.com/profile.php?id=1234"},
+	} {
+		if got, err := URL(tc.in); err != nil {
+			t.Errorf("URL(%q) failed: %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("URL(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{"ftp://example.org/", "mailto:user@example.org", "https://", "/relative"} {
+		if got, err := URL(in); err == nil {
+			t.Errorf("URL(%q) = %q; want error", in, got)
+		}
+	}
+}
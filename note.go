@@ -0,0 +1,92 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"strings"
+	"text/template"
+)
+
+// expandEditNote expands tmpl, an edit note written as a text/template, using
+// orig (the unmodified URL) and res (the changes that will be made to it).
+// See editNoteData for the available fields, e.g. "{{.Orig.Name}}".
+func expandEditNote(tmpl string, orig *entityInfo, res *urlResult) (string, error) {
+	if !strings.Contains(tmpl, "{{") {
+		return tmpl, nil
+	}
+	t, err := template.New("").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	data := editNoteData{
+		Orig:      newEditNoteEntity(orig),
+		Rewritten: res.rewritten,
+		Target:    res.target,
+	}
+	if data.Rewritten == "" {
+		data.Rewritten = orig.name
+	}
+	for _, rel := range res.updatedRels {
+		data.UpdatedRels = append(data.UpdatedRels, newEditNoteRel(&rel, orig.name))
+	}
+	for i := range res.newURLs {
+		data.NewURLs = append(data.NewURLs, newEditNoteEntity(&res.newURLs[i]))
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, &data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// editNoteData is passed to edit note templates.
+type editNoteData struct {
+	Orig        editNoteEntity   // URL before changes
+	Rewritten   string           // rewritten URL (same as Orig.Name if unchanged)
+	Target      string           // URL found by the rule (e.g. a redirect target), if any
+	UpdatedRels []editNoteRel    // relationships that will be updated
+	NewURLs     []editNoteEntity // URLs that will be related to Orig's targets
+}
+
+// editNoteEntity describes an entityInfo within editNoteData.
+type editNoteEntity struct {
+	MBID string
+	Name string // or URL
+	Rels []editNoteRel
+}
+
+func newEditNoteEntity(info *entityInfo) editNoteEntity {
+	ent := editNoteEntity{MBID: info.mbid, Name: info.name}
+	for _, rel := range info.rels {
+		ent.Rels = append(ent.Rels, newEditNoteRel(&rel, info.name))
+	}
+	return ent
+}
+
+// editNoteRel describes a relInfo within editNoteData.
+type editNoteRel struct {
+	ID         int
+	LinkTypeID int
+	Desc       string // from relInfo.desc
+	TargetMBID string
+	TargetName string
+	TargetType string
+	BeginDate  string // e.g. "2017-05-03", "2017-05", or ""
+	EndDate    string
+	Ended      bool
+}
+
+func newEditNoteRel(rel *relInfo, name string) editNoteRel {
+	return editNoteRel{
+		ID:         rel.id,
+		LinkTypeID: rel.linkTypeID,
+		Desc:       rel.desc(name),
+		TargetMBID: rel.targetMBID,
+		TargetName: rel.targetName,
+		TargetType: rel.targetType,
+		BeginDate:  rel.beginDate.String(),
+		EndDate:    rel.endDate.String(),
+		Ended:      rel.ended,
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultProbeQPS = 1
+	probeTimeout    = 30 * time.Second
+	probeMaxBody    = 64 * 1024 // maximum bytes of response body to inspect
+)
+
+// prober checks whether external sites are still alive.
+// It uses its own rate limiter since probed sites are unrelated to MusicBrainz.
+type prober struct {
+	client  http.Client
+	limiter *rate.Limiter
+	// lookupHost resolves hostnames. It's a field so tests can replace it.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.Mutex
+	cache map[string]*probeResult // keyed by scheme and host, e.g. "https://example.org"
+}
+
+func newProber(qps rate.Limit) *prober {
+	return &prober{
+		client:     http.Client{Timeout: probeTimeout},
+		limiter:    rate.NewLimiter(qps, 1),
+		lookupHost: net.DefaultResolver.LookupHost,
+		cache:      make(map[string]*probeResult),
+	}
+}
+
+// probeStatus describes the state of a site.
+type probeStatus string
+
+const (
+	probeAlive  probeStatus = "alive"
+	probeGone   probeStatus = "gone"    // site returned 410 Gone
+	probeParked probeStatus = "parked"  // site redirected to or served a parked or for-sale page
+	probeNoHost probeStatus = "no-host" // hostname doesn't resolve
+	probeError  probeStatus = "error"   // inconclusive, e.g. timeout or server error
+)
+
+// probeResult describes the result of probing a site.
+type probeResult struct {
+	status       probeStatus
+	code         int       // final HTTP status code, if any
+	finalURL     string    // URL after following redirects, if any
+	lastModified time.Time // from Last-Modified header of probeGone response, if any
+	err          error     // error that produced probeError
+}
+
+// dead returns true if r confirms that the site is no longer alive.
+func (r *probeResult) dead() bool {
+	return r.status == probeGone || r.status == probeParked || r.status == probeNoHost
+}
+
+// String returns a short human-readable description of r.
+func (r *probeResult) String() string {
+	switch r.status {
+	case probeGone:
+		return "site returns 410 Gone"
+	case probeParked:
+		return "site is parked at " + r.finalURL
+	case probeNoHost:
+		return "hostname doesn't resolve"
+	case probeError:
+		return fmt.Sprint("probe failed: ", r.err)
+	default:
+		return fmt.Sprintf("site returns %d", r.code)
+	}
+}
+
+// probeSite probes the root page of the site with the supplied scheme and host
+// (e.g. "https" and "www.example.org"). Results are cached.
+func (p *prober) probeSite(ctx context.Context, scheme, host string) (*probeResult, error) {
+	key := strings.ToLower(scheme + "://" + host)
+	p.mu.Lock()
+	res, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok {
+		return res, nil
+	}
+
+	if err := p.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	res = p.probe(ctx, key+"/")
+	if ctx.Err() != nil {
+		return nil, ctx.Err() // don't cache results from canceled probes
+	}
+	p.mu.Lock()
+	p.cache[key] = res
+	p.mu.Unlock()
+	return res, nil
+}
+
+// probe fetches u and classifies the response.
+func (p *prober) probe(ctx context.Context, u string) *probeResult {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return &probeResult{status: probeError, err: err}
+	}
+	if hn := req.URL.Hostname(); net.ParseIP(hn) == nil {
+		if _, err := p.lookupHost(ctx, hn); err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return &probeResult{status: probeNoHost}
+			}
+			return &probeResult{status: probeError, err: err}
+		}
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return &probeResult{status: probeError, err: err}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, probeMaxBody))
+
+	res := probeResult{code: resp.StatusCode, finalURL: resp.Request.URL.String()}
+	switch {
+	case parkedHostRegexp.MatchString(resp.Request.URL.Hostname()) || parkedBodyRegexp.Match(body):
+		// Don't use the parked page's Last-Modified header, since it says nothing about
+		// when the original site went away.
+		res.status = probeParked
+	case resp.StatusCode == http.StatusGone:
+		res.status = probeGone
+		if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			res.lastModified = t
+		}
+	case resp.StatusCode >= 500:
+		res.status = probeError
+		res.err = errors.New(resp.Status)
+	default:
+		res.status = probeAlive
+	}
+	return &res
+}
+
+// followRedirects follows up to maxHops permanent (301 or 308) redirects starting at u.
+// The final URL is returned; it is u if no permanent redirects were found.
+// Temporary redirects end the chain, since their targets aren't canonical.
+func (p *prober) followRedirects(ctx context.Context, u string, maxHops int) (string, error) {
+	client := p.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	for hop := 0; ; hop++ {
+		if err := p.limiter.Wait(ctx); err != nil {
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusPermanentRedirect {
+			return u, nil
+		}
+		if hop == maxHops {
+			return "", fmt.Errorf("more than %d redirects", maxHops)
+		}
+		loc, err := resp.Location()
+		if err != nil {
+			return "", err
+		}
+		u = loc.String()
+	}
+}
+
+// loginPathRegexp matches URL paths of login pages.
+var loginPathRegexp = regexp.MustCompile(`(?i)(?:^|/)(?:log-?in|sign-?in|sign_in|auth|authorize)(?:[/.]|$)`)
+
+// isFallbackRedirect returns true if target, the final destination of a chain of
+// redirects from orig, appears to be a site's homepage or login page rather than a
+// new location for orig's content. Sites often permanently redirect removed pages there.
+func isFallbackRedirect(orig, target *url.URL) bool {
+	if loginPathRegexp.MatchString(target.Path) && !loginPathRegexp.MatchString(orig.Path) {
+		return true
+	}
+	return strings.Trim(target.Path, "/") == "" && strings.Trim(orig.Path, "/") != ""
+}
+
+var (
+	// parkedHostRegexp matches hostnames of domain-parking and domain-sale services.
+	parkedHostRegexp = regexp.MustCompile(`(?i)(?:^|\.)(?:` +
+		`sedo(?:parking)?\.com|dan\.com|afternic\.com|hugedomains\.com|bodis\.com|parkingcrew\.net|` +
+		`above\.com|domainmarket\.com|undeveloped\.com|sav\.com|parklogic\.com)$`)
+	// parkedBodyRegexp matches text commonly included in parked pages.
+	parkedBodyRegexp = regexp.MustCompile(`(?i)(?:this domain (?:name )?(?:is|may be) for sale|` +
+		`buy this domain|domain is parked|parked free, courtesy of)`)
+)
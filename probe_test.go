@@ -0,0 +1,272 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+// newTestProber returns a prober that sends all requests to a local server.
+// Hostnames in noHosts fail to resolve.
+func newTestProber(t *testing.T, handler http.HandlerFunc, noHosts ...string) (*prober, *int) {
+	var reqs int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqs++
+		handler(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	p := newProber(rate.Inf)
+	p.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+	p.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		for _, h := range noHosts {
+			if h == host {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+	return p, &reqs
+}
+
+func TestProber_ProbeSite(t *testing.T) {
+	p, reqs := newTestProber(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Host {
+		case "alive.example":
+			io.WriteString(w, "<html>Welcome to my band's page</html>")
+		case "gone.example":
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			w.WriteHeader(http.StatusGone)
+		case "redirect.example":
+			http.Redirect(w, req, "http://www.sedo.com/search/details/?domain=redirect.example", http.StatusFound)
+		case "www.sedo.com":
+			io.WriteString(w, "<html>Make an offer</html>")
+		case "forsale.example":
+			io.WriteString(w, "<html>This domain may be for sale!</html>")
+		case "broken.example":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			t.Errorf("Unexpected request for %v", req.Host)
+			http.NotFound(w, req)
+		}
+	}, "nxdomain.example")
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		host string
+		want probeStatus
+		dead bool
+	}{
+		{"alive.example", probeAlive, false},
+		{"gone.example", probeGone, true},
+		{"redirect.example", probeParked, true},
+		{"forsale.example", probeParked, true},
+		{"broken.example", probeError, false},
+		{"nxdomain.example", probeNoHost, true},
+	} {
+		res, err := p.probeSite(ctx, "http", tc.host)
+		if err != nil {
+			t.Errorf("probeSite(ctx, %q, %q) failed: %v", "http", tc.host, err)
+		} else if res.status != tc.want || res.dead() != tc.dead {
+			t.Errorf("probeSite(ctx, %q, %q) = %v (dead %v); want %v (dead %v)",
+				"http", tc.host, res.status, res.dead(), tc.want, tc.dead)
+		}
+	}
+
+	// Results should be cached.
+	before := *reqs
+	if _, err := p.probeSite(ctx, "http", "gone.example"); err != nil {
+		t.Error("probeSite failed:", err)
+	}
+	if *reqs != before {
+		t.Errorf("probeSite made %d request(s) for cached site", *reqs-before)
+	}
+}
+
+func TestDeadLinkRule(t *testing.T) {
+	p, _ := newTestProber(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Host {
+		case "alive.example":
+			io.WriteString(w, "<html>Still here</html>")
+		case "gone.example":
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			w.WriteHeader(http.StatusGone)
+		case "parked.example":
+			w.Header().Set("Last-Modified", "Fri, 01 Mar 2019 12:00:00 GMT")
+			io.WriteString(w, "<html>Buy this domain</html>")
+		default:
+			http.NotFound(w, req)
+		}
+	}, "nxdomain.example")
+
+	ctx := context.Background()
+	d := date{2003, 7, 9} // arbitrary
+	for _, tc := range []struct {
+		url     string
+		endDate date // ruleEnv.endDate
+		rels    []relInfo
+		want    []relInfo // nil if unchanged
+		flagged bool      // URL should be flagged instead of edited
+	}{
+		{"http://alive.example/page", date{}, []relInfo{{id: 1}}, nil, false},
+		{"http://gone.example/page", date{}, []relInfo{{id: 1}}, []relInfo{{id: 1, ended: true, endDate: date{2015, 10, 21}}}, false},
+		{"http://gone.example/page", d, []relInfo{{id: 1}, {id: 2, ended: true}},
+			[]relInfo{{id: 1, ended: true, endDate: d}}, false},
+		{"http://parked.example/", date{}, []relInfo{{id: 1}}, nil, true},
+		{"http://parked.example/", d, []relInfo{{id: 1}}, []relInfo{{id: 1, ended: true, endDate: d}}, false},
+		{"https://nxdomain.example/", date{}, []relInfo{{id: 1}}, nil, true},
+		{"https://nxdomain.example/", d, []relInfo{{id: 1}}, []relInfo{{id: 1, ended: true, endDate: d}}, false},
+		{"https://nxdomain.example/", date{}, []relInfo{{id: 1, ended: true}}, nil, false},
+	} {
+		orig := entityInfo{name: tc.url, typ: urlType, rels: tc.rels}
+		env := ruleEnv{probe: p, endDate: tc.endDate}
+		res, err := runURLFunc(ctx, &env, &orig, "dead-link")
+		if err != nil {
+			t.Errorf("runURLFunc(ctx, env, %v, %q) failed: %v", orig, "dead-link", err)
+			continue
+		}
+		var got []relInfo
+		var flagged bool
+		if res != nil {
+			got, flagged = res.updatedRels, len(res.flags) > 0
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("runURLFunc(ctx, env, %v, %q) updated %v; want %v", orig, "dead-link", got, tc.want)
+		}
+		if flagged != tc.flagged {
+			t.Errorf("runURLFunc(ctx, env, %v, %q) flagged = %v; want %v", orig, "dead-link", flagged, tc.flagged)
+		}
+	}
+
+	// The rule should be skipped unless it's requested by name, and when the network isn't available.
+	orig := entityInfo{name: "https://nxdomain.example/", typ: urlType, rels: []relInfo{{id: 1}}}
+	if res, err := runURLFunc(ctx, &ruleEnv{probe: p}, &orig, ""); err != nil || res != nil {
+		t.Errorf("runURLFunc(ctx, env, %v, %q) = %+v, %v; want nil", orig, "", res, err)
+	}
+	if res, err := runURLFunc(ctx, nil, &orig, "dead-link"); err != nil || res != nil {
+		t.Errorf("runURLFunc(ctx, nil, %v, %q) = %+v, %v; want nil", orig, "dead-link", res, err)
+	}
+}
+
+func TestRedirectRule(t *testing.T) {
+	p, _ := newTestProber(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Host + req.URL.Path {
+		case "a.example/old":
+			http.Redirect(w, req, "/new", http.StatusMovedPermanently)
+		case "www.b.example/x":
+			http.Redirect(w, req, "http://b.example/y", http.StatusMovedPermanently)
+		case "b.example/y":
+			http.Redirect(w, req, "/z", http.StatusPermanentRedirect)
+		case "temp.example/":
+			http.Redirect(w, req, "/login", http.StatusFound)
+		case "old.example/artist":
+			http.Redirect(w, req, "http://new.example/artist", http.StatusMovedPermanently)
+		case "loop.example/":
+			http.Redirect(w, req, "/", http.StatusMovedPermanently)
+		case "gone.example/album/1":
+			http.Redirect(w, req, "/", http.StatusMovedPermanently)
+		case "members.example/page":
+			http.Redirect(w, req, "/account/login?next=%2Fpage", http.StatusMovedPermanently)
+		case "tmpl.example/old":
+			http.Redirect(w, req, "/new?q={{x}}%25", http.StatusMovedPermanently)
+		default:
+			io.WriteString(w, "<html>OK</html>")
+		}
+	})
+
+	ctx := context.Background()
+	d := date{2003, 7, 9} // arbitrary
+	for _, tc := range []struct {
+		url       string
+		mode      string
+		hosts     []string
+		rels      []relInfo
+		rewritten string       // "" if unchanged
+		updated   []relInfo    // for redirectMigrate
+		newURLs   []entityInfo // for redirectMigrate
+		wantErr   bool
+	}{
+		{url: "http://a.example/old", rewritten: "http://a.example/new"},
+		{url: "http://a.example/new"},
+		{url: "http://www.b.example/x", rewritten: "http://b.example/z"},
+		{url: "http://temp.example/"},
+		{url: "http://old.example/artist"},
+		{url: "http://old.example/artist", hosts: []string{"new.example"}, rewritten: "http://new.example/artist"},
+		{url: "http://loop.example/", wantErr: true},
+		{url: "http://gone.example/album/1"}, // homepage
+		{url: "http://members.example/page"}, // login page
+		{url: "http://tmpl.example/old", rewritten: "http://tmpl.example/new?q={{x}}%25"},
+		{
+			url:  "http://a.example/old",
+			mode: redirectMigrate,
+			rels: []relInfo{
+				{id: 1, linkTypeID: 978, targetType: "artist", backward: true},
+				{id: 2, linkTypeID: 978, targetType: "artist", backward: true, ended: true, endDate: d},
+			},
+			updated: []relInfo{{id: 1, linkTypeID: 978, targetType: "artist", backward: true, ended: true, endDate: d}},
+			newURLs: []entityInfo{{
+				name: "http://a.example/new",
+				typ:  urlType,
+				rels: []relInfo{{linkTypeID: 978, targetType: "artist", backward: true, beginDate: d}},
+			}},
+		},
+	} {
+		orig := entityInfo{name: tc.url, typ: urlType, rels: tc.rels}
+		env := ruleEnv{probe: p, endDate: d, redirectMode: tc.mode, redirectHosts: tc.hosts, maxRedirects: 3}
+		res, err := runURLFunc(ctx, &env, &orig, "redirect")
+		if err != nil {
+			if !tc.wantErr {
+				t.Errorf("runURLFunc(ctx, env, %q, %q) failed: %v", tc.url, "redirect", err)
+			}
+			continue
+		} else if tc.wantErr {
+			t.Errorf("runURLFunc(ctx, env, %q, %q) unexpectedly succeeded", tc.url, "redirect")
+			continue
+		}
+
+		if tc.rewritten == "" {
+			tc.rewritten = tc.url
+		}
+		if res == nil {
+			if tc.rewritten != tc.url || tc.updated != nil || tc.newURLs != nil {
+				t.Errorf("runURLFunc(ctx, env, %q, %q) didn't rewrite", tc.url, "redirect")
+			}
+			continue
+		}
+		if res.rewritten != tc.rewritten {
+			t.Errorf("runURLFunc(ctx, env, %q, %q) rewrote URL to %q; want %q",
+				tc.url, "redirect", res.rewritten, tc.rewritten)
+		}
+		if !reflect.DeepEqual(res.updatedRels, tc.updated) {
+			t.Errorf("runURLFunc(ctx, env, %q, %q) updated rels %v; want %v",
+				tc.url, "redirect", res.updatedRels, tc.updated)
+		}
+		if !reflect.DeepEqual(res.newURLs, tc.newURLs) {
+			t.Errorf("runURLFunc(ctx, env, %q, %q) added URLs %v; want %v",
+				tc.url, "redirect", res.newURLs, tc.newURLs)
+		}
+		target := tc.rewritten
+		if len(tc.newURLs) > 0 {
+			target = tc.newURLs[0].name
+		}
+		if note, err := expandEditNote(res.editNote, &orig, res); err != nil {
+			t.Errorf("Expanding edit note for %q failed: %v", tc.url, err)
+		} else if !strings.HasSuffix(note, " -> "+target) {
+			t.Errorf("Edit note for %q is %q; want target %q", tc.url, note, target)
+		}
+	}
+}
@@ -6,8 +6,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // relInfo describes a relationship between one entity and another.
@@ -22,6 +27,24 @@ type relInfo struct {
 	targetMBID string
 	targetName string
 	targetType string // entity type, e.g. "artist", "release", "recording"
+	targetCred string // name that target entity is credited as, if any
+	attrs      string // sorted, comma-separated link attribute type MBIDs; see joinAttrs
+}
+
+// joinAttrs returns a string for relInfo.attrs containing the supplied link attribute type MBIDs.
+// A string is used rather than a slice so that relInfo can be compared using ==.
+func joinAttrs(gids []string) string {
+	gids = append([]string(nil), gids...)
+	sort.Strings(gids)
+	return strings.Join(gids, ",")
+}
+
+// splitAttrs returns the link attribute type MBIDs in a string returned by joinAttrs.
+func splitAttrs(attrs string) []string {
+	if attrs == "" {
+		return nil
+	}
+	return strings.Split(attrs, ",")
 }
 
 // desc returns a string describing the relationship belonging to name,
@@ -31,7 +54,11 @@ func (rel *relInfo) desc(name string) string {
 	if target == "" {
 		target = rel.targetMBID
 	}
-	phrase := rel.linkPhrase + fmt.Sprintf("[%d]", rel.linkTypeID)
+	phrase := rel.linkPhrase
+	if lt := linkTypes.get(rel.linkTypeID); lt != nil && phrase == "" {
+		phrase = lt.LinkPhrase
+	}
+	phrase += fmt.Sprintf("[%d]", rel.linkTypeID)
 
 	var s string
 	if rel.backward {
@@ -48,6 +75,17 @@ func (rel *relInfo) desc(name string) string {
 	return s
 }
 
+// hasEquivalentRel returns true if rels contains a relationship with the same
+// link type, target, and direction as rel.
+func hasEquivalentRel(rels []relInfo, rel *relInfo) bool {
+	for _, r := range rels {
+		if r.linkTypeID == rel.linkTypeID && r.targetMBID == rel.targetMBID && r.backward == rel.backward {
+			return true
+		}
+	}
+	return false
+}
+
 // filterRels returns relationships to targets of the specified type, e.g. "artist".
 func filterRels(rels []relInfo, entityType string) []relInfo {
 	var filtered []relInfo
@@ -59,16 +97,135 @@ func filterRels(rels []relInfo, entityType string) []relInfo {
 	return filtered
 }
 
+// filterEndedRels returns relationships whose ended field matches ended.
+func filterEndedRels(rels []relInfo, ended bool) []relInfo {
+	var filtered []relInfo
+	for _, rel := range rels {
+		if rel.ended == ended {
+			filtered = append(filtered, rel)
+		}
+	}
+	return filtered
+}
+
 type date struct{ year, month, day int }
 
 func (d *date) empty() bool { return d.year == 0 && d.month == 0 && d.day == 0 }
 
+// validate returns an error if d isn't a valid calendar date.
+// Partial dates like 2017-05-00 and 2017-00-00 are permitted.
+func (d *date) validate() error {
+	if d.year < 0 || d.year > 9999 || d.month < 0 || d.month > 12 || d.day < 0 {
+		return fmt.Errorf("invalid date %v", d)
+	}
+	if d.day != 0 {
+		if d.month == 0 {
+			return fmt.Errorf("date %v has day but not month", d)
+		}
+		year := d.year
+		if year == 0 {
+			year = 2000 // leap year, so Feb 29 is accepted
+		}
+		// Day 0 of the following month is the last day of this month.
+		if last := time.Date(year, time.Month(d.month+1), 0, 0, 0, 0, 0, time.UTC).Day(); d.day > last {
+			return fmt.Errorf("invalid date %v", d)
+		}
+	}
+	return nil
+}
+
+// before returns true if d is known to be before o.
+// Only components that are set in both dates are compared.
+func (d *date) before(o date) bool {
+	for _, p := range [][2]int{{d.year, o.year}, {d.month, o.month}, {d.day, o.day}} {
+		if p[0] == 0 || p[1] == 0 {
+			return false
+		} else if p[0] != p[1] {
+			return p[0] < p[1]
+		}
+	}
+	return false
+}
+
+// latest returns the last moment covered by d, which must be non-empty.
+// For example, 2017-05 produces the end of May 31, 2017 (UTC).
+func (d *date) latest() time.Time {
+	switch {
+	case d.month == 0:
+		return time.Date(d.year+1, time.January, 1, 0, 0, 0, 0, time.UTC).Add(-time.Second)
+	case d.day == 0:
+		return time.Date(d.year, time.Month(d.month+1), 1, 0, 0, 0, 0, time.UTC).Add(-time.Second)
+	default:
+		return time.Date(d.year, time.Month(d.month), d.day+1, 0, 0, 0, 0, time.UTC).Add(-time.Second)
+	}
+}
+
+// validateRelDates returns an error if rel's dates are invalid, if its end date precedes
+// its begin date, or if it has dates but its link type (per linkTypes) doesn't support them.
+// If clamp is true, an end date preceding the begin date is instead set to the begin date.
+func validateRelDates(rel *relInfo, clamp bool) error {
+	if err := rel.beginDate.validate(); err != nil {
+		return fmt.Errorf("bad begin date: %v", err)
+	}
+	if err := rel.endDate.validate(); err != nil {
+		return fmt.Errorf("bad end date: %v", err)
+	}
+	if lt := linkTypes.get(rel.linkTypeID); lt != nil && !lt.HasDates &&
+		(rel.ended || !rel.beginDate.empty() || !rel.endDate.empty()) {
+		return fmt.Errorf("link type %d (%q) doesn't support dates", lt.ID, lt.Name)
+	}
+	if rel.endDate.before(rel.beginDate) {
+		if !clamp {
+			return fmt.Errorf("end date %v precedes begin date %v", rel.endDate, rel.beginDate)
+		}
+		rel.endDate = rel.beginDate
+	}
+	return nil
+}
+
+// parseDate parses a date formatted like "2017-05-03", "2017-05", or "2017".
+// An empty string produces an empty date.
+func parseDate(s string) (date, error) {
+	var d date
+	if s == "" {
+		return d, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) > 3 {
+		return d, fmt.Errorf("bad date %q", s)
+	}
+	dst := []*int{&d.year, &d.month, &d.day}
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return d, fmt.Errorf("bad date %q", s)
+		}
+		*dst[i] = v
+	}
+	return d, nil
+}
+
+// String formats d as e.g. "2017-05-03", omitting unknown trailing components.
+func (d date) String() string {
+	switch {
+	case d.empty():
+		return ""
+	case d.month == 0:
+		return fmt.Sprintf("%04d", d.year)
+	case d.day == 0:
+		return fmt.Sprintf("%04d-%02d", d.year, d.month)
+	default:
+		return fmt.Sprintf("%04d-%02d-%02d", d.year, d.month, d.day)
+	}
+}
+
 // setRelEditVals sets values needed by the /relationship-editor endpoint.
 // pre is prepended to each parameter name and should be e.g. "rel-editor.rels.0".
+// src is the type of the entity that rel belongs to.
 // If orig is non-nil, an "edit" request is set with differences between orig and rel.
 // If orig is nil, an "add" request is set to create a new relationship.
 // The caller must set entity-related parameters when creating new relationships.
-func setRelEditVals(vals map[string]string, pre string, rel relInfo, orig *relInfo) error {
+func setRelEditVals(vals map[string]string, pre string, src entityType, rel relInfo, orig *relInfo) error {
 	if orig == nil {
 		if rel.id != 0 {
 			return fmt.Errorf("invalid rel %d", rel.id)
@@ -76,6 +233,9 @@ func setRelEditVals(vals map[string]string, pre string, rel relInfo, orig *relIn
 	} else if rel == *orig {
 		return fmt.Errorf("no changes for rel %d", rel.id)
 	}
+	if err := linkTypes.validate(&rel, src); err != nil {
+		return fmt.Errorf("invalid rel %d: %v", rel.id, err)
+	}
 
 	// These parameters are handled by lib/MusicBrainz/Server/Controller/RelationshipEditor.pm.
 	origCnt := len(vals)
@@ -104,6 +264,13 @@ func setRelEditVals(vals map[string]string, pre string, rel relInfo, orig *relIn
 	if (orig == nil && rel.ended) || (orig != nil && rel.ended != orig.ended) {
 		vals[pre+"period.ended"] = boolToParam(rel.ended)
 	}
+	if orig == nil {
+		for i, gid := range splitAttrs(rel.attrs) {
+			vals[fmt.Sprintf("%sattributes.%d.type.gid", pre, i)] = gid
+		}
+	} else if rel.attrs != orig.attrs || rel.targetCred != orig.targetCred {
+		return fmt.Errorf("unsupported attribute or credit update for rel %d", rel.id)
+	}
 	if len(vals) == origCnt {
 		return fmt.Errorf("unsupported update for rel (%+v)", rel)
 	}
@@ -122,41 +289,203 @@ func setRelEditVals(vals map[string]string, pre string, rel relInfo, orig *relIn
 	return nil
 }
 
-// postRelEdit posts vals to /relationship-editor.
-// IDs of created relationships are returned.
-// If existing relationships are edited, IDs are 0.
-func postRelEdit(ctx context.Context, srv *server, vals map[string]string,
-	editNote string, makeVotable bool) ([]int, error) {
+// setRelRemoveVals sets values needed by the /relationship-editor endpoint to remove rel.
+// pre is prepended to each parameter name and should be e.g. "rel-editor.rels.0".
+func setRelRemoveVals(vals map[string]string, pre string, rel relInfo) {
+	vals[pre+"action"] = "remove"
+	vals[pre+"id"] = strconv.Itoa(rel.id)
+	vals[pre+"link_type"] = strconv.Itoa(rel.linkTypeID)
+}
+
+// Response codes reported for individual relationship changes by /relationship-editor.
+// See $WS_EDIT_RESPONSE_* in lib/MusicBrainz/Server/Constants.pm.
+const (
+	relEditResponseOK        = 1
+	relEditResponseNoChanges = 2
+)
+
+var (
+	errRelNoChanges = errors.New("relationship change had no effect")
+	errRelDuplicate = errors.New("relationship already exists")
+	errRelNotFound  = errors.New("relationship or entity not found")
+	errRelInvalid   = errors.New("invalid relationship change")
+	errRelNoResult  = errors.New("no result for relationship change")
+)
+
+// relEditResponseError is used for unrecognized /relationship-editor response codes.
+type relEditResponseError struct {
+	editType int
+	code     int
+}
+
+func (e *relEditResponseError) Error() string {
+	return fmt.Sprintf("edit with type %v failed: %v", e.editType, e.code)
+}
+
+// relEditRejectedError is used when /relationship-editor rejects a whole submission,
+// in which case none of its changes were applied.
+type relEditRejectedError struct {
+	msg string // error message from server
+	err error  // errRelDuplicate, errRelNotFound, errRelInvalid, or nil if unrecognized
+}
+
+// newRelEditRejectedError returns a relEditRejectedError for the supplied error message.
+func newRelEditRejectedError(msg string) *relEditRejectedError {
+	e := relEditRejectedError{msg: msg}
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "already exists"):
+		e.err = errRelDuplicate
+	case strings.Contains(lower, "not found") || strings.Contains(lower, "does not exist") ||
+		strings.Contains(lower, "doesn't exist"):
+		e.err = errRelNotFound
+	case strings.Contains(lower, "invalid") || strings.Contains(lower, "not allowed"):
+		e.err = errRelInvalid
+	}
+	return &e
+}
+
+func (e *relEditRejectedError) Error() string { return fmt.Sprintf("submission rejected: %q", e.msg) }
+func (e *relEditRejectedError) Unwrap() error { return e.err }
+
+// relEditOutcome describes the result of submitting a single relationship change.
+type relEditOutcome struct {
+	rel relInfo // relationship that was submitted
+	id  int     // ID of created relationship, or 0 if an existing relationship was changed
+	err error   // nil if the change was applied
+}
+
+// postRelEdit posts vals to /relationship-editor. rels should contain the relationships
+// described by vals, ordered by rel-editor.rels index, and an outcome is returned for
+// each of them. If the server rejects the whole submission (e.g. because one of the
+// relationships already exists), each outcome contains a *relEditRejectedError.
+// Nothing is retried; callers can resubmit failed changes using selectRelVals.
+// A non-nil error is returned without outcomes if the submission failed for another
+// reason, e.g. an edit limit or a network error.
+func postRelEdit(ctx context.Context, srv *server, vals map[string]string, rels []relInfo,
+	editNote string, makeVotable bool) ([]relEditOutcome, error) {
+	if n := countRelEdits(vals); n != len(rels) {
+		return nil, fmt.Errorf("got %d relationship change(s) for %d relationship(s)", n, len(rels))
+	}
+	results, err := submitRelEdits(ctx, srv, vals, editNote, makeVotable)
+	var rej *relEditRejectedError
+	if errors.As(err, &rej) {
+		outs := make([]relEditOutcome, len(rels))
+		for i, rel := range rels {
+			outs[i] = relEditOutcome{rel: rel, err: rej}
+		}
+		return outs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	outs := make([]relEditOutcome, len(rels))
+	for i, rel := range rels {
+		outs[i].rel = rel
+		if i >= len(results) {
+			outs[i].err = errRelNoResult
+		} else {
+			outs[i].id = results[i].RelationshipID
+			outs[i].err = results[i].err()
+		}
+	}
+	return outs, nil
+}
+
+// relEditResult describes the server's response to a single relationship change
+// in a /relationship-editor submission.
+type relEditResult struct {
+	RelationshipID int `json:"relationship_id"`
+	EditType       int `json:"edit_type"`
+	Response       int `json:"response"`
+}
+
+// err returns nil if res reports success or an error describing its response code.
+func (res *relEditResult) err() error {
+	switch res.Response {
+	case relEditResponseOK:
+		return nil
+	case relEditResponseNoChanges:
+		return errRelNoChanges
+	default:
+		return &relEditResponseError{res.EditType, res.Response}
+	}
+}
+
+// submitRelEdits posts vals to /relationship-editor and returns the server's
+// per-relationship results, which are ordered by rel-editor.rels index.
+func submitRelEdits(ctx context.Context, srv *server, vals map[string]string,
+	editNote string, makeVotable bool) ([]relEditResult, error) {
 	// Set additional parameters.
 	vals["rel-editor.edit_note"] = editNote
 	if makeVotable {
 		vals["rel-editor.make_votable"] = "1"
 	}
 
-	b, err := srv.post(ctx, "/relationship-editor", vals)
+	b, err := srv.postEdit(ctx, "/relationship-editor", vals, countRelEdits(vals))
 	if err != nil {
-		return nil, fmt.Errorf("%v (%q)", err, b)
+		// The whole submission is rejected if any change is invalid, e.g. because
+		// a relationship already exists.
+		var se *statusError
+		if errors.As(err, &se) && se.code == http.StatusBadRequest {
+			if msg := relEditErrorMessage(b); msg != "" {
+				return nil, newRelEditRejectedError(msg)
+			}
+		}
+		return nil, fmt.Errorf("%w (%q)", err, b)
 	}
 	// The response is written by submit_edits in lib/MusicBrainz/Server/Controller/WS/js/Edit.pm,
 	// which oddly doesn't include the actual edit IDs.
 	var data struct {
-		Edits []struct {
-			RelationshipID int `json:"relationship_id"`
-			EditType       int `json:"edit_type"`
-			Response       int `json:"response"`
-		} `json:"edits"`
+		Edits []relEditResult `json:"edits"`
 	}
 	if err := json.Unmarshal(b, &data); err != nil {
 		return nil, fmt.Errorf("unmarshaling response: %v", err)
 	}
-	var ids []int
-	for i, ed := range data.Edits {
-		if ed.Response != 1 {
-			return ids, fmt.Errorf("relationship edit %v with type %v failed: %v", i, ed.EditType, ed.Response)
+	return data.Edits, nil
+}
+
+// relEditErrorMessage returns the message from an error response from /relationship-editor,
+// or an empty string if b isn't an error response.
+func relEditErrorMessage(b []byte) string {
+	var data struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &data) != nil {
+		return ""
+	}
+	return data.Error
+}
+
+// relEditPrefix is the prefix of /relationship-editor parameters describing individual relationships.
+const relEditPrefix = "rel-editor.rels."
+
+// countRelEdits returns the number of relationships described by /relationship-editor parameters.
+func countRelEdits(vals map[string]string) int {
+	var n int
+	for k := range vals {
+		if strings.HasPrefix(k, relEditPrefix) && strings.HasSuffix(k, ".action") {
+			n++
 		}
-		ids = append(ids, ed.RelationshipID)
 	}
-	return ids, nil
+	return n
+}
+
+// copyRelVals copies relationship parameters from src to dst, adding offset to their indexes.
+// Parameters not describing individual relationships are not copied.
+func copyRelVals(dst, src map[string]string, offset int) error {
+	for k, v := range src {
+		if !strings.HasPrefix(k, relEditPrefix) {
+			continue
+		}
+		parts := strings.SplitN(k[len(relEditPrefix):], ".", 2)
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return fmt.Errorf("bad relationship parameter %q", k)
+		}
+		dst[fmt.Sprintf("%s%d.%s", relEditPrefix, idx+offset, parts[1])] = v
+	}
+	return nil
 }
 
 // boolToParam returns a string corresponding to v to use as a parameter passed to MusicBrainz.
@@ -167,3 +496,18 @@ func boolToParam(v bool) string {
 	}
 	return "0"
 }
+
+// selectRelVals returns a copy of the relationship parameters in vals for the relationships
+// at the supplied indexes. The relationships are renumbered starting at 0.
+func selectRelVals(vals map[string]string, idxs []int) map[string]string {
+	sel := make(map[string]string)
+	for j, i := range idxs {
+		pre := fmt.Sprintf("%s%d.", relEditPrefix, i)
+		for k, v := range vals {
+			if strings.HasPrefix(k, pre) {
+				sel[fmt.Sprintf("%s%d.%s", relEditPrefix, j, k[len(pre):])] = v
+			}
+		}
+	}
+	return sel
+}
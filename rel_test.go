@@ -0,0 +1,191 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestValidateRelDates(t *testing.T) {
+	for _, tc := range []struct {
+		begin, end date
+		ended      bool
+		clamp      bool
+		valid      bool
+		wantEnd    date
+	}{
+		{date{}, date{}, false, false, true, date{}},
+		{date{2017, 5, 0}, date{2017, 5, 3}, true, false, true, date{2017, 5, 3}},
+		{date{2017, 5, 3}, date{2017, 5, 0}, true, false, true, date{2017, 5, 0}},
+		{date{2017, 0, 0}, date{2018, 2, 28}, true, false, true, date{2018, 2, 28}},
+		{date{2016, 2, 29}, date{}, false, false, true, date{}},
+		{date{2017, 2, 29}, date{}, false, false, false, date{}},
+		{date{2017, 4, 31}, date{}, false, false, false, date{}},
+		{date{2017, 13, 0}, date{}, false, false, false, date{}},
+		{date{2017, 0, 5}, date{}, false, false, false, date{}},
+		{date{}, date{2017, 6, 31}, true, false, false, date{}},
+		{date{2010, 1, 1}, date{2009, 10, 26}, true, false, false, date{}},
+		{date{2010, 1, 1}, date{2009, 10, 26}, true, true, true, date{2010, 1, 1}},
+		{date{2009, 11, 0}, date{2009, 10, 26}, true, false, false, date{}},
+	} {
+		rel := relInfo{linkTypeID: 978, targetType: "artist", beginDate: tc.begin, endDate: tc.end, ended: tc.ended}
+		err := validateRelDates(&rel, tc.clamp)
+		if err != nil && tc.valid {
+			t.Errorf("validateRelDates(%v to %v, %v) failed: %v", tc.begin, tc.end, tc.clamp, err)
+		} else if err == nil && !tc.valid {
+			t.Errorf("validateRelDates(%v to %v, %v) unexpectedly succeeded", tc.begin, tc.end, tc.clamp)
+		} else if err == nil && rel.endDate != tc.wantEnd {
+			t.Errorf("validateRelDates(%v to %v, %v) set end date %v; want %v",
+				tc.begin, tc.end, tc.clamp, rel.endDate, tc.wantEnd)
+		}
+	}
+}
+
+func TestValidateRelDates_NoPeriod(t *testing.T) {
+	orig := linkTypes
+	defer func() { linkTypes = orig }()
+	linkTypes = mustParseLinkTypes([]byte(`[{"id": 352, "name": "wikidata", "type0": "artist", "type1": "url"}]`))
+
+	rel := relInfo{linkTypeID: 352, targetType: "artist", backward: true}
+	if err := validateRelDates(&rel, false); err != nil {
+		t.Errorf("validateRelDates(%+v, false) failed: %v", rel, err)
+	}
+	rel.ended = true
+	if err := validateRelDates(&rel, false); err == nil {
+		t.Errorf("validateRelDates(%+v, false) unexpectedly succeeded", rel)
+	}
+}
+
+func TestPostRelEdit(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	env.relResponses = map[string]int{"2": relEditResponseNoChanges, "3": 0}
+
+	var rels []relInfo
+	vals := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		rel := relInfo{id: i + 1, linkTypeID: 3}
+		setRelRemoveVals(vals, fmt.Sprintf("%s%d.", relEditPrefix, i), rel)
+		rels = append(rels, rel)
+	}
+	outs, err := postRelEdit(ctx, env.srv, vals, rels, "note", false)
+	if err != nil {
+		t.Fatal("postRelEdit failed:", err)
+	}
+
+	wantErrs := []error{nil, errRelNoChanges, &relEditResponseError{1, 0}, nil}
+	if len(outs) != len(rels) {
+		t.Fatalf("postRelEdit returned %d outcome(s); want %d", len(outs), len(rels))
+	}
+	for i, out := range outs {
+		if out.rel.id != rels[i].id {
+			t.Errorf("Outcome %d is for relationship %d; want %d", i, out.rel.id, rels[i].id)
+		}
+		if want := wantErrs[i]; want == nil && out.err != nil {
+			t.Errorf("Relationship %d failed: %v", out.rel.id, out.err)
+		} else if want != nil && !errors.Is(out.err, want) && fmt.Sprint(out.err) != fmt.Sprint(want) {
+			t.Errorf("Relationship %d returned %v; want %v", out.rel.id, out.err, want)
+		}
+	}
+
+	// Failed changes shouldn't be retried.
+	if len(env.requests) != 1 {
+		t.Errorf("postRelEdit sent %d request(s); want 1", len(env.requests))
+	}
+}
+
+func TestPostRelEdit_Rejected(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	// The server rejects the whole submission if a single relationship already exists.
+	env.relErrors = map[string]string{"2": "This relationship already exists."}
+
+	var rels []relInfo
+	vals := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		rel := relInfo{id: i + 1, linkTypeID: 3}
+		setRelRemoveVals(vals, fmt.Sprintf("%s%d.", relEditPrefix, i), rel)
+		rels = append(rels, rel)
+	}
+	outs, err := postRelEdit(ctx, env.srv, vals, rels, "note", false)
+	if err != nil {
+		t.Fatal("postRelEdit failed:", err)
+	}
+	if len(outs) != len(rels) {
+		t.Fatalf("postRelEdit returned %d outcome(s); want %d", len(outs), len(rels))
+	}
+	for _, out := range outs {
+		var rej *relEditRejectedError
+		if !errors.As(out.err, &rej) || !errors.Is(out.err, errRelDuplicate) {
+			t.Errorf("Relationship %d returned %v; want rejection with %v", out.rel.id, out.err, errRelDuplicate)
+		}
+	}
+	if len(env.requests) != 1 {
+		t.Errorf("postRelEdit sent %d request(s); want 1", len(env.requests))
+	}
+}
+
+func TestPostRelEdit_Failure(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	env.postStatus = func(n int) int { return http.StatusInternalServerError }
+	vals := make(map[string]string)
+	rels := []relInfo{{id: 1, linkTypeID: 3}}
+	setRelRemoveVals(vals, relEditPrefix+"0.", rels[0])
+	if outs, err := postRelEdit(ctx, env.srv, vals, rels, "note", false); err == nil || outs != nil {
+		t.Errorf("postRelEdit returned %+v, %v; want error", outs, err)
+	}
+}
+
+func TestNewRelEditRejectedError(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want error
+	}{
+		{"This relationship already exists.", errRelDuplicate},
+		{"Relationship not found", errRelNotFound},
+		{"Entity 123 does not exist", errRelNotFound},
+		{"Invalid link type", errRelInvalid},
+		{"Something else went wrong", nil},
+	} {
+		err := newRelEditRejectedError(tc.msg)
+		if got := errors.Unwrap(err); got != tc.want {
+			t.Errorf("newRelEditRejectedError(%q) wraps %v; want %v", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestPostRelEdit_NoResult(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	// Changes without results may have been applied, so they shouldn't be retried.
+	env.relResults = 1
+	vals := make(map[string]string)
+	rels := []relInfo{{id: 1, linkTypeID: 3}, {id: 2, linkTypeID: 3}}
+	for i, rel := range rels {
+		setRelRemoveVals(vals, fmt.Sprintf("%s%d.", relEditPrefix, i), rel)
+	}
+	outs, err := postRelEdit(ctx, env.srv, vals, rels, "note", false)
+	if err != nil {
+		t.Fatal("postRelEdit failed:", err)
+	}
+	if len(outs) != 2 || outs[0].err != nil || !errors.Is(outs[1].err, errRelNoResult) {
+		t.Errorf("postRelEdit returned %+v; want success and %v", outs, errRelNoResult)
+	}
+	if len(env.requests) != 1 {
+		t.Errorf("postRelEdit sent %d request(s); want 1", len(env.requests))
+	}
+}
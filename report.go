@@ -0,0 +1,44 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Statuses passed to reporter.add.
+const (
+	reportSkipped  = "skipped"   // entity was intentionally left unchanged
+	reportInvalid  = "invalid"   // a change to the entity was invalid and wasn't submitted
+	reportFlagged  = "flagged"   // entity needs manual review
+	reportNotFound = "not-found" // entity wasn't found in the database
+	reportChanged  = "changed"   // entity was edited concurrently by someone else
+	reportDeferred = "deferred"  // entity was skipped and added to the defer file
+	reportFailed   = "failed"    // edits for the entity were rejected by the server
+)
+
+// reporter records entities that weren't processed normally.
+// All methods may be called on a nil reporter, in which case entries are just logged.
+type reporter struct {
+	w io.Writer // receives tab-separated lines with MBID, status, and message
+}
+
+func newReporter(w io.Writer) *reporter { return &reporter{w} }
+
+// add logs and records that the entity with the supplied MBID had the supplied status.
+// The remaining arguments are passed to fmt.Sprintf to produce a descriptive message.
+func (r *reporter) add(mbid, status, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("%v: %v: %v", mbid, status, msg)
+	if r == nil || r.w == nil {
+		return
+	}
+	msg = strings.NewReplacer("\t", " ", "\n", " ").Replace(msg)
+	if _, err := fmt.Fprintf(r.w, "%s\t%s\t%s\n", mbid, status, msg); err != nil {
+		log.Print("Failed writing report: ", err)
+	}
+}
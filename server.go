@@ -14,7 +14,9 @@ import (
 	"net/http/cookiejar"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/time/rate"
 )
@@ -30,17 +32,34 @@ const (
 // server communicates with the MusicBrainz website.
 type server struct {
 	serverURL    string // e.g. "https://musicbrainz.org"
+	user         string // name of logged-in user
 	client       http.Client
 	limiter      *rate.Limiter
 	jar          *cookiejar.Jar
 	dryRun       bool           // if true, don't perform edits
 	editIDRegexp *regexp.Regexp // matches ID in <server>/edit/<id> URLs
+	cache        *entityCache   // used by getEntityInfo if non-nil
+
+	maxEdits      int           // maximum edits to submit via postEdit; 0 for no limit
+	numEdits      int           // edits submitted so far via postEdit
+	maxOpenEdits  int           // maximum open edits for user; 0 for no limit
+	openEditsWait time.Duration // time to wait when maxOpenEdits is reached; 0 to give up
 }
 
 var (
 	// These fragile regexps are used to extract hidden inputs from the login form.
 	csrfSessionKeyRegexp = regexp.MustCompile(`<input name="csrf_session_key"\s+type="hidden"\s+value="([^"]+)"`)
 	csrfTokenRegexp      = regexp.MustCompile(`<input name="csrf_token"\s+type="hidden"\s+value="([^"]+)"`)
+
+	// editCountRegexp is used to extract the number of edits from an edit list page.
+	editCountRegexp = regexp.MustCompile(`Found (?:at least )?([\d,]+) edits?`)
+)
+
+var (
+	// errMaxEdits is returned by postEdit after the limit set via serverMaxEdits is reached.
+	errMaxEdits = errors.New("reached maximum number of edits")
+	// errMaxOpenEdits is returned by postEdit if the user has too many open edits.
+	errMaxOpenEdits = errors.New("reached maximum number of open edits")
 )
 
 type serverOption func(srv *server)
@@ -52,10 +71,32 @@ func serverDryRun(dryRun bool) serverOption {
 	return func(srv *server) { srv.dryRun = dryRun }
 }
 
+// serverCache caches entities fetched via getEntityInfo under dir for up to ttl (0 for no limit).
+// If refresh is true, existing cache entries are ignored.
+func serverCache(dir string, ttl time.Duration, refresh bool) serverOption {
+	return func(srv *server) { srv.cache = newEntityCache(dir, srv.serverURL, ttl, refresh) }
+}
+
+// serverMaxEdits limits the total number of edits submitted via postEdit.
+func serverMaxEdits(max int) serverOption {
+	return func(srv *server) { srv.maxEdits = max }
+}
+
+// serverMaxOpenEdits checks the user's open edit count before each postEdit call.
+// If the count would exceed max, postEdit waits for wait before checking again,
+// or fails with errMaxOpenEdits if wait is 0.
+func serverMaxOpenEdits(max int, wait time.Duration) serverOption {
+	return func(srv *server) {
+		srv.maxOpenEdits = max
+		srv.openEditsWait = wait
+	}
+}
+
 func newServer(ctx context.Context, serverURL, user, pass string, opts ...serverOption) (*server, error) {
 	// Wait until after login to initialize the rate-limiter.
 	srv := server{
 		serverURL:    serverURL,
+		user:         user,
 		editIDRegexp: regexp.MustCompile(regexp.QuoteMeta(serverURL) + `/edit/(\d+)\b`),
 	}
 
@@ -124,6 +165,62 @@ func (srv *server) post(ctx context.Context, path string, vals map[string]string
 	return srv.send(ctx, http.MethodPost, path, vals)
 }
 
+// postEdit is a wrapper around post for requests that create n edits.
+// errMaxEdits or errMaxOpenEdits is returned if the request would exceed
+// the limits set via serverMaxEdits or serverMaxOpenEdits.
+func (srv *server) postEdit(ctx context.Context, path string, vals map[string]string, n int) ([]byte, error) {
+	if srv.maxEdits > 0 && srv.numEdits+n > srv.maxEdits {
+		return nil, errMaxEdits
+	}
+	if srv.maxOpenEdits > 0 {
+		for {
+			cnt, err := srv.getOpenEdits(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("getting open edits: %w", err)
+			}
+			if cnt+n <= srv.maxOpenEdits {
+				break
+			}
+			if srv.openEditsWait <= 0 {
+				return nil, errMaxOpenEdits
+			}
+			log.Printf("Have %d open edit(s); waiting %v", cnt, srv.openEditsWait)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(srv.openEditsWait):
+			}
+		}
+	}
+
+	b, err := srv.post(ctx, path, vals)
+	if err == nil {
+		srv.numEdits += n
+	}
+	return b, err
+}
+
+// getOpenEdits returns the number of open edits belonging to the logged-in user.
+func (srv *server) getOpenEdits(ctx context.Context) (int, error) {
+	b, err := srv.get(ctx, "/user/"+url.PathEscape(srv.user)+"/edits/open")
+	if err != nil {
+		return 0, err
+	}
+	return parseEditCount(b)
+}
+
+// parseEditCount extracts the number of edits from an edit list page.
+func parseEditCount(b []byte) (int, error) {
+	ms := editCountRegexp.FindSubmatch(b)
+	if ms == nil {
+		if strings.Contains(string(b), "No edits found") {
+			return 0, nil
+		}
+		return 0, errors.New("didn't find edit count")
+	}
+	return strconv.Atoi(strings.ReplaceAll(string(ms[1]), ",", ""))
+}
+
 // send sends a request for path with the supplied URL-encoded parameters as a body.
 // The response body is returned. All non-200 responses (after following redirects)
 // cause an error to be returned.
@@ -146,7 +243,11 @@ func (srv *server) send(ctx context.Context, method, path string, vals map[strin
 			log.Printf("POST %v with body %q", u, form.Encode())
 			switch {
 			case path == "/relationship-editor":
-				return []byte(`{"edits":[{"edit_type":1,"response":1}]}`), nil
+				edits := make([]string, countRelEdits(vals))
+				for i := range edits {
+					edits[i] = `{"edit_type":1,"response":1}`
+				}
+				return []byte(`{"edits":[` + strings.Join(edits, ",") + `]}`), nil
 			case strings.HasSuffix(path, "/edit"):
 				return []byte(srv.serverURL + "/edit/0"), nil // matched by editIDRegexp
 			}
@@ -177,7 +278,21 @@ func (srv *server) send(ctx context.Context, method, path string, vals map[strin
 
 	b, err := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		return b, fmt.Errorf("got %v: %v", resp.StatusCode, resp.Status)
+		return b, &statusError{resp.StatusCode, resp.Status}
 	}
 	return b, err
 }
+
+// statusError is returned by send for non-200 responses.
+type statusError struct {
+	code   int    // e.g. 404
+	status string // e.g. "404 Not Found"
+}
+
+func (e *statusError) Error() string { return fmt.Sprintf("got %v: %v", e.code, e.status) }
+
+// isNotFound returns true if err is a statusError with a 404 code.
+func isNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.code == http.StatusNotFound
+}
@@ -5,10 +5,11 @@ package main
 
 import (
 	"bufio"
-	"fmt"
 	"io"
+	"math/rand"
 	"regexp"
-	"strconv"
+	"sort"
+	"strings"
 )
 
 // sliceContains returns true if vals contains s.
@@ -21,6 +22,17 @@ func sliceContains(vals []string, s string) bool {
 	return false
 }
 
+// splitList splits a comma-separated list, trimming whitespace and dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // readLine reads the next line from sc.
 // If an error was encountered (possibly during an earlier read), it is returned.
 // After all lines have been read successfully, io.EOF is returned.
@@ -34,25 +46,36 @@ func readLine(sc *bufio.Scanner) (string, error) {
 	return "", io.EOF
 }
 
-// readInt is a wrapper around readLine that converts lines to ints.
-func readInt(sc *bufio.Scanner) (int, error) {
-	ln, err := readLine(sc)
-	if err != nil {
-		return 0, err
+// selectItems returns a subset of items.
+// If sample is positive, reservoir sampling (using rnd) is used to choose that many items,
+// which are returned in their original order. If limit is positive, at most that many
+// items are returned.
+func selectItems[T any](items []T, limit, sample int, rnd *rand.Rand) []T {
+	if sample <= 0 {
+		if limit > 0 && len(items) > limit {
+			return items[:limit]
+		}
+		return items
 	}
-	return strconv.Atoi(ln)
-}
 
-// readMBID is a wrapper around readLine that checks that lines contain valid UUIDs.
-func readMBID(sc *bufio.Scanner) (string, error) {
-	ln, err := readLine(sc)
-	if err != nil {
-		return "", err
+	// Choose indexes so the selected items can be returned in their original order.
+	var idxs []int
+	for i := range items {
+		if len(idxs) < sample {
+			idxs = append(idxs, i)
+		} else if j := rnd.Intn(i + 1); j < sample {
+			idxs[j] = i
+		}
+	}
+	sort.Ints(idxs)
+	if limit > 0 && len(idxs) > limit {
+		idxs = idxs[:limit]
 	}
-	if !mbidRegexp.MatchString(ln) {
-		return "", fmt.Errorf("invalid MBID %q", ln)
+	selected := make([]T, len(idxs))
+	for i, idx := range idxs {
+		selected[i] = items[idx]
 	}
-	return ln, nil
+	return selected
 }
 
 // mbidRegexp matches a MusicBrainz ID (i.e. a UUID).
@@ -0,0 +1,40 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSelectItems(t *testing.T) {
+	input := []string{"a", "b", "c", "d", "e"}
+	for _, tc := range []struct {
+		limit, sample int
+		want          int // number of lines
+	}{
+		{0, 0, 5},
+		{3, 0, 3},
+		{10, 0, 5},
+		{0, 2, 2},
+		{0, 10, 5},
+		{1, 3, 1},
+	} {
+		rnd := rand.New(rand.NewSource(1))
+		lines := selectItems(input, tc.limit, tc.sample, rnd)
+		if len(lines) != tc.want {
+			t.Errorf("selectItems(..., %d, %d, ...) returned %q; want %d line(s)", tc.limit, tc.sample, lines, tc.want)
+		}
+		if tc.sample == 0 && !strings.HasPrefix(strings.Join(input, ""), strings.Join(lines, "")) {
+			t.Errorf("selectItems(..., %d, %d, ...) returned %q; want prefix of input", tc.limit, tc.sample, lines)
+		}
+		for i := 1; i < len(lines); i++ {
+			if lines[i] <= lines[i-1] {
+				t.Errorf("selectItems(..., %d, %d, ...) returned out-of-order lines %q", tc.limit, tc.sample, lines)
+				break
+			}
+		}
+	}
+}
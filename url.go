@@ -7,38 +7,162 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"regexp"
+	"strings"
+	"time"
+
+	"github.com/derat/mbbot/normalize"
 )
 
+// urlOptions configures processURL.
+type urlOptions struct {
+	editNote       string // edit note template to attach to edits instead of the rule's note
+	appendEditNote bool   // append editNote to the rule's note instead of replacing it
+	makeVotable    bool   // force voting on edits
+	rule           string // name of single rule from urlRules to apply; all rules used if empty
+	existingURL    string // existingURL* value describing how to handle rewrites to existing URLs
+	clampDates     bool   // clamp end dates preceding begin dates rather than skipping relationships
+	endDate        date   // end date used by generic rules; see ruleEnv
+	// overrideEndDate replaces the end dates of relationships ended by the rule if non-empty.
+	// Relationships that the rule added to new URLs starting at the old end date begin at this date instead.
+	overrideEndDate date
+	probe           *prober
+	redirectMode    string   // see ruleEnv
+	redirectHosts   []string // see ruleEnv
+	maxRedirects    int      // see ruleEnv
+	archiveURL      string   // availability API base URL for finding snapshots of ended URLs; disabled if empty
+	// verifyAfter is the maximum time between fetching the URL and submitting edits.
+	// If more time has elapsed, the URL is refetched and skipped if it changed.
+	verifyAfter time.Duration
+	// skipOpenEdits skips URLs that already have open edits. If deferred is non-nil,
+	// the MBIDs of skipped URLs are written to it so they can be processed later.
+	skipOpenEdits bool
+	deferred      io.Writer
+	// batch accumulates relationship changes across URLs if non-nil. The caller must flush it.
+	batch  *relBatch
+	report *reporter
+}
+
+// Values for urlOptions.existingURL.
+const (
+	existingURLSkip  = "skip"  // leave the URL unchanged and report it
+	existingURLMerge = "merge" // rewrite the URL anyway and let MusicBrainz merge it into the existing URL
+	existingURLMove  = "move"  // move relationships to the existing URL
+)
+
+var allExistingURLs = []string{existingURLSkip, existingURLMerge, existingURLMove}
+
 // processURL attempts to process the URL with the specified MBID.
-// If editNote is non-empty, it will be attached to the edit.
-// If makeVotable is true, voting will be forced.
 // If no updates are performed, a nil error is returned.
-func processURL(ctx context.Context, srv *server, mbid, editNote string, makeVotable bool) error {
+func processURL(ctx context.Context, srv *server, mbid string, opts *urlOptions) error {
 	info, err := getEntityInfo(ctx, srv, mbid, urlType)
 	if err != nil {
 		return fmt.Errorf("failed getting URL: %v", err)
 	}
-	res := runURLFunc(info)
-	if res == nil {
+	env := ruleEnv{
+		probe:         opts.probe,
+		endDate:       opts.endDate,
+		redirectMode:  opts.redirectMode,
+		redirectHosts: opts.redirectHosts,
+		maxRedirects:  opts.maxRedirects,
+	}
+	res, err := runURLFunc(ctx, &env, info, opts.rule)
+	if err == nil && res != nil && info.cached && !srv.dryRun {
+		// Never edit against cached data: refetch the URL and run the rules again.
+		// Dry runs don't edit, so cached data is good enough for them.
+		log.Printf("%v: refetching cached URL before editing", mbid)
+		if info, err = getFreshEntityInfo(ctx, srv, mbid, urlType); err != nil {
+			return fmt.Errorf("failed refetching URL: %v", err)
+		}
+		res, err = runURLFunc(ctx, &env, info, opts.rule)
+	}
+	if err != nil {
+		return fmt.Errorf("failed running rule: %v", err)
+	} else if res == nil {
 		log.Printf("%v: no rewrites found for %v", mbid, info.name)
 		return nil
+	} else if len(res.flags) > 0 {
+		for _, f := range res.flags {
+			opts.report.add(mbid, reportFlagged, "%v: %v", info.name, f)
+		}
+		return nil
+	}
+	if opts.skipOpenEdits {
+		if n, err := getEntityOpenEdits(ctx, srv, mbid, urlType); err != nil {
+			return fmt.Errorf("failed getting open edits: %v", err)
+		} else if n > 0 {
+			if opts.deferred == nil {
+				opts.report.add(mbid, reportSkipped, "%v has %d open edit(s)", info.name, n)
+			} else if _, err := fmt.Fprintln(opts.deferred, mbid); err != nil {
+				return fmt.Errorf("failed deferring URL: %v", err)
+			} else {
+				opts.report.add(mbid, reportDeferred, "%v has %d open edit(s)", info.name, n)
+			}
+			return nil
+		}
+	}
+	if !opts.overrideEndDate.empty() {
+		overrideEndDates(info, res, opts.overrideEndDate)
+	}
+	if opts.editNote != "" {
+		if opts.appendEditNote && res.editNote != "" {
+			res.editNote += "\n\n" + opts.editNote
+		} else {
+			res.editNote = opts.editNote
+		}
+	}
+	if res.rewritten != "" && res.rewritten != info.name {
+		if skip, err := handleExistingURL(ctx, srv, info, res, opts); err != nil {
+			return err
+		} else if skip {
+			return nil
+		}
 	}
-	if editNote != "" {
-		res.editNote = editNote
+	res.updatedRels = checkRelDates(mbid, info.name, res.updatedRels, opts)
+	for i := range res.newURLs {
+		nu := &res.newURLs[i]
+		nu.rels = checkRelDates(mbid, nu.name, nu.rels, opts)
+	}
+	// Don't remove anything if some of the relationships wouldn't be added to the existing URL.
+	if mv := res.move; mv != nil {
+		if valid := checkRelDates(mbid, mv.to.name, mv.to.rels, opts); len(valid) < len(mv.to.rels) {
+			opts.report.add(mbid, reportSkipped, "not moving relationships since %d are invalid",
+				len(mv.to.rels)-len(valid))
+			return nil
+		}
+	}
+	if res.editNote, err = expandEditNote(res.editNote, info, res); err != nil {
+		return fmt.Errorf("bad edit note: %v", err)
+	}
+	if opts.archiveURL != "" && opts.probe != nil {
+		res.editNote += findSnapshots(ctx, opts, info, res.updatedRels)
+	}
+	if !srv.dryRun && time.Since(info.fetched) > opts.verifyAfter {
+		if changed, err := entityChanged(ctx, srv, info); err != nil {
+			return fmt.Errorf("failed verifying URL: %v", err)
+		} else if changed {
+			opts.report.add(mbid, reportChanged, "%v changed concurrently", info.name)
+			return nil
+		}
 	}
 
+	// Batched relationship changes are submitted later, so the URL is checked for concurrent
+	// changes again before they're submitted. This isn't possible if the URL is edited here.
+	verify := info
 	if res.rewritten != "" && res.rewritten != info.name {
+		verify = nil
 		log.Printf("%v: rewriting %v to %v", mbid, info.name, res.rewritten)
 		vals := map[string]string{
 			"edit-url.url":       res.rewritten,
 			"edit-url.edit_note": res.editNote,
 		}
-		if makeVotable {
+		if opts.makeVotable {
 			vals["edit-url.make_votable"] = "1"
 		}
-		b, err := srv.post(ctx, "/url/"+mbid+"/edit", vals)
+		b, err := srv.postEdit(ctx, "/url/"+mbid+"/edit", vals, 1)
 		if err != nil {
 			return err
 		}
@@ -58,77 +182,430 @@ func processURL(ctx context.Context, srv *server, mbid, editNote string, makeVot
 		for i, rel := range res.updatedRels {
 			log.Printf("%v: editing relationship %v (%q)", mbid, rel.id, rel.desc(info.name))
 			pre := fmt.Sprintf("rel-editor.rels.%d.", i)
-			if err := setRelEditVals(vals, pre, rel, oldRels[rel.id]); err != nil {
+			if err := setRelEditVals(vals, pre, urlType, rel, oldRels[rel.id]); err != nil {
 				return err
 			}
 		}
-		if ids, err := postRelEdit(ctx, srv, vals, res.editNote, makeVotable); err != nil {
+		if opts.batch != nil {
+			ent := relBatchEntry{mbid: mbid, name: info.name, verify: verify}
+			if err := opts.batch.add(ctx, ent, res.updatedRels, vals, res.editNote, opts.makeVotable); err != nil {
+				return err
+			}
+		} else if outs, err := postRelEdit(ctx, srv, vals, res.updatedRels,
+			res.editNote, opts.makeVotable); err != nil {
 			return err
 		} else {
-			log.Printf("%v: edited %v relationship(s)", mbid, len(ids))
+			applied := reportRelOutcomes(opts.report, mbid, info.name, outs)
+			log.Printf("%v: edited %v relationship(s)", mbid, len(applied))
 		}
 	}
 
 	for _, info := range res.newURLs {
-		vals := make(map[string]string)
-		for i, rel := range info.rels {
+		if len(info.rels) == 0 {
+			continue
+		}
+		for _, rel := range info.rels {
 			log.Printf("%v: adding relationship (%q)", mbid, rel.desc(info.name))
-			pre := fmt.Sprintf("rel-editor.rels.%d.", i)
-			if err := setRelEditVals(vals, pre, rel, nil); err != nil {
+		}
+		vals := make(map[string]string)
+		if err := setAddURLRelVals(vals, info.name, info.rels); err != nil {
+			return err
+		}
+		if opts.batch != nil {
+			ent := relBatchEntry{mbid: mbid, name: info.name, verify: verify}
+			if err := opts.batch.add(ctx, ent, info.rels, vals, res.editNote, opts.makeVotable); err != nil {
 				return err
 			}
-			// I think that the "normal" ordering sorts entities by type name, so we should use
-			// [artist,url], [recording,url], and [release,url], but [url,work]. So weird.
-			if (rel.backward && rel.targetType > "url") || (!rel.backward && rel.targetType < "url") {
-				return fmt.Errorf("incorrect direction for relationship %q", rel.desc(info.name))
-			}
-			urlPre, targetPre := pre+"entity.0", pre+"entity.1"
-			if rel.backward {
-				urlPre, targetPre = targetPre, urlPre
-			}
-			vals[urlPre+".url"] = info.name
-			vals[urlPre+".type"] = "url"
-			vals[targetPre+".gid"] = rel.targetMBID
-			vals[targetPre+".type"] = rel.targetType
-		}
-		if ids, err := postRelEdit(ctx, srv, vals, res.editNote, makeVotable); err != nil {
+		} else if outs, err := postRelEdit(ctx, srv, vals, info.rels,
+			res.editNote, opts.makeVotable); err != nil {
 			return err
 		} else {
-			for _, id := range ids {
-				log.Printf("%v: added relationship %v", mbid, id)
+			for _, out := range reportRelOutcomes(opts.report, mbid, info.name, outs) {
+				log.Printf("%v: added relationship %v", mbid, out.id)
 			}
 		}
 	}
 
+	if res.move != nil {
+		if err := moveRels(ctx, srv, info, res, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setAddURLRelVals sets values needed by the /relationship-editor endpoint to add rels
+// to the URL with the supplied name.
+func setAddURLRelVals(vals map[string]string, name string, rels []relInfo) error {
+	for i, rel := range rels {
+		pre := fmt.Sprintf("rel-editor.rels.%d.", i)
+		if err := setRelEditVals(vals, pre, urlType, rel, nil); err != nil {
+			return err
+		}
+		// I think that the "normal" ordering sorts entities by type name, so we should use
+		// [artist,url], [recording,url], and [release,url], but [url,work]. So weird.
+		if (rel.backward && rel.targetType > "url") || (!rel.backward && rel.targetType < "url") {
+			return fmt.Errorf("incorrect direction for relationship %q", rel.desc(name))
+		}
+		urlPre, targetPre := pre+"entity.0", pre+"entity.1"
+		if rel.backward {
+			urlPre, targetPre = targetPre, urlPre
+		}
+		vals[urlPre+".url"] = name
+		vals[urlPre+".type"] = "url"
+		vals[targetPre+".gid"] = rel.targetMBID
+		vals[targetPre+".type"] = rel.targetType
+		if rel.targetCred != "" {
+			vals[targetPre+".credit"] = rel.targetCred
+		}
+	}
+	return nil
+}
+
+// moveRels adds res.move's relationships to the existing URL and then removes the original
+// relationships from orig. Original relationships are only removed if they were added successfully
+// or if the existing URL already had them. The additions are submitted immediately even if
+// opts.batch is set, since the removals depend on them.
+func moveRels(ctx context.Context, srv *server, orig *entityInfo, res *urlResult, opts *urlOptions) error {
+	mv := res.move
+	added := make(map[int]bool, len(mv.to.rels))
+	if len(mv.to.rels) > 0 {
+		for _, rel := range mv.to.rels {
+			log.Printf("%v: adding relationship (%q)", orig.mbid, rel.desc(mv.to.name))
+		}
+		vals := make(map[string]string)
+		if err := setAddURLRelVals(vals, mv.to.name, mv.to.rels); err != nil {
+			return err
+		}
+		outs, err := postRelEdit(ctx, srv, vals, mv.to.rels, res.editNote, opts.makeVotable)
+		if err != nil {
+			return err
+		}
+		reportRelOutcomes(opts.report, orig.mbid, mv.to.name, outs)
+		for i, out := range outs {
+			added[i] = out.err == nil
+		}
+	}
+
+	vals := make(map[string]string)
+	var rels []relInfo
+	for i, rel := range mv.rels {
+		if j := mv.adds[i]; j >= 0 && !added[j] {
+			log.Printf("%v: not removing relationship %v (%q) since it wasn't moved", orig.mbid, rel.id, rel.desc(orig.name))
+			continue
+		}
+		log.Printf("%v: removing relationship %v (%q)", orig.mbid, rel.id, rel.desc(orig.name))
+		setRelRemoveVals(vals, fmt.Sprintf("rel-editor.rels.%d.", len(rels)), rel)
+		rels = append(rels, rel)
+	}
+	if len(rels) == 0 {
+		return nil
+	}
+	if opts.batch != nil {
+		ent := relBatchEntry{mbid: orig.mbid, name: orig.name, verify: orig}
+		return opts.batch.add(ctx, ent, rels, vals, res.editNote, opts.makeVotable)
+	}
+	outs, err := postRelEdit(ctx, srv, vals, rels, res.editNote, opts.makeVotable)
+	if err != nil {
+		return err
+	}
+	applied := reportRelOutcomes(opts.report, orig.mbid, orig.name, outs)
+	log.Printf("%v: removed %v relationship(s)", orig.mbid, len(applied))
 	return nil
 }
 
-// runURLFunc looks for an appropriate function in urlFuncs for the supplied URL.
+// reportRelOutcomes reports relationship changes in outs that failed. The relationships
+// belong to the entity with the supplied MBID and name. Changes that were applied are returned.
+func reportRelOutcomes(rep *reporter, mbid, name string, outs []relEditOutcome) []relEditOutcome {
+	var applied []relEditOutcome
+	for _, out := range outs {
+		switch {
+		case out.err == nil:
+			applied = append(applied, out)
+		case errors.Is(out.err, errRelNoChanges):
+			log.Printf("%v: %q: %v", mbid, out.rel.desc(name), out.err)
+		default:
+			rep.add(mbid, reportFailed, "%q: %v", out.rel.desc(name), out.err)
+		}
+	}
+	return applied
+}
+
+// checkRelDates checks the dates in rels, which belong to the entity with the supplied MBID and
+// name, using validateRelDates. Invalid relationships are reported and omitted from the returned slice.
+func checkRelDates(mbid, name string, rels []relInfo, opts *urlOptions) []relInfo {
+	var valid []relInfo
+	for _, rel := range rels {
+		if err := validateRelDates(&rel, opts.clampDates); err != nil {
+			opts.report.add(mbid, reportInvalid, "%q: %v", rel.desc(name), err)
+			continue
+		}
+		valid = append(valid, rel)
+	}
+	return valid
+}
+
+// findSnapshots looks for archived snapshots of orig preceding the end dates of
+// rels that are ended. A string listing the snapshots is returned for use in an edit note.
+// Failures are logged and otherwise ignored.
+func findSnapshots(ctx context.Context, opts *urlOptions, orig *entityInfo, rels []relInfo) string {
+	var note string
+	seen := make(map[date]struct{})
+	for _, rel := range rels {
+		if !rel.ended {
+			continue
+		}
+		if _, ok := seen[rel.endDate]; ok {
+			continue
+		}
+		seen[rel.endDate] = struct{}{}
+		snap, err := opts.probe.findSnapshot(ctx, opts.archiveURL, orig.name, rel.endDate)
+		if err != nil {
+			log.Printf("%v: failed finding archived snapshot: %v", orig.mbid, err)
+		} else if snap == "" {
+			log.Printf("%v: no archived snapshot before %v", orig.mbid, rel.endDate)
+		} else {
+			log.Printf("%v: found archived snapshot %v", orig.mbid, snap)
+			note += "\n\nArchived copy: " + snap
+		}
+	}
+	return note
+}
+
+// handleExistingURL checks whether res.rewritten already exists as a URL entity other than orig.
+// If it does, res is updated as described by opts.existingURL.
+// If orig should be left unchanged, true is returned.
+func handleExistingURL(ctx context.Context, srv *server, orig *entityInfo,
+	res *urlResult, opts *urlOptions) (skip bool, err error) {
+	mbid, err := lookupURL(ctx, srv, res.rewritten)
+	if err != nil {
+		return false, fmt.Errorf("failed looking up %v: %v", res.rewritten, err)
+	} else if mbid == "" || mbid == orig.mbid {
+		return false, nil
+	}
+
+	switch opts.existingURL {
+	case existingURLMerge:
+		// MusicBrainz doesn't have a separate edit for merging URLs. Instead, the URL is
+		// rewritten as usual and the server merges it into the existing URL when the edit
+		// is applied, so just tell voters what will happen.
+		log.Printf("%v: merging into existing URL %v", orig.mbid, mbid)
+		res.editNote += fmt.Sprintf("\n\n%v already exists as %v/url/%v, so this edit merges the two URLs.",
+			res.rewritten, srv.serverURL, mbid)
+		return false, nil
+
+	case existingURLMove:
+		existing, err := getFreshEntityInfo(ctx, srv, mbid, urlType)
+		if err != nil {
+			return false, fmt.Errorf("failed getting existing URL: %v", err)
+		}
+		updated := make(map[int]relInfo, len(res.updatedRels))
+		for _, rel := range res.updatedRels {
+			updated[rel.id] = rel
+		}
+		mv := urlMove{to: entityInfo{mbid: existing.mbid, typ: urlType, name: existing.name}}
+		for _, rel := range orig.rels {
+			mv.rels = append(mv.rels, rel)
+			if up, ok := updated[rel.id]; ok {
+				rel = up
+			}
+			if hasEquivalentRel(existing.rels, &rel) {
+				mv.adds = append(mv.adds, -1)
+				continue
+			}
+			rel.id = 0
+			mv.adds = append(mv.adds, len(mv.to.rels))
+			mv.to.rels = append(mv.to.rels, rel)
+		}
+		if len(mv.rels) == 0 {
+			opts.report.add(orig.mbid, reportSkipped, "%v already exists as %v and there are no relationships to move",
+				res.rewritten, mbid)
+			return true, nil
+		}
+		log.Printf("%v: moving %d relationship(s) to existing URL %v", orig.mbid, len(mv.rels), mbid)
+		res.rewritten = orig.name
+		res.updatedRels = nil
+		res.move = &mv
+		res.editNote += fmt.Sprintf("\n\nMoving relationships to existing URL %v/url/%v.", srv.serverURL, mbid)
+		return false, nil
+
+	default:
+		opts.report.add(orig.mbid, reportSkipped, "%v already exists as %v", res.rewritten, mbid)
+		return true, nil
+	}
+}
+
+// runURLFunc looks for an appropriate rule in urlRules for the supplied URL.
+// If rule is non-empty, only the rule with the supplied name is considered.
+// Rules that use the network are skipped if env or env.probe is nil.
 // If the URL isn't matched or is unchanged after processing, nil is returned.
-func runURLFunc(url *entityInfo) *urlResult {
-	for re, fn := range urlFuncs {
-		if ms := re.FindStringSubmatch(url.name); ms != nil {
+func runURLFunc(ctx context.Context, env *ruleEnv, url *entityInfo, rule string) (*urlResult, error) {
+	for _, r := range urlRules {
+		if (rule != "" && r.name != rule) || (rule == "" && r.explicit) {
+			continue
+		}
+		if ms := r.re.FindStringSubmatch(url.name); ms != nil {
 			cp := *url
 			cp.rels = append([]relInfo(nil), url.rels...)
-			res := fn(&cp, ms)
-			if res == nil || (res.rewritten == url.name && len(res.updatedRels) == 0 && len(res.newURLs) == 0) {
-				return nil // unchanged
+			var res *urlResult
+			if r.netFn != nil {
+				if env == nil || env.probe == nil {
+					return nil, nil
+				}
+				var err error
+				if res, err = r.netFn(ctx, env, &cp, ms); err != nil {
+					return nil, err
+				}
+			} else {
+				res = r.fn(&cp, ms)
+			}
+			if res == nil || (res.rewritten == url.name && len(res.updatedRels) == 0 &&
+				len(res.newURLs) == 0 && len(res.flags) == 0) {
+				return nil, nil // unchanged
 			}
-			return res
+			return res, nil
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 // urlFunc accepts the match groups returned by FindStringSubmatch and returns updates.
 // nil may be returned to abort processing.
 type urlFunc func(url *entityInfo, ms []string) *urlResult
 
+// netURLFunc is like urlFunc but may use env to access the network.
+type netURLFunc func(ctx context.Context, env *ruleEnv, url *entityInfo, ms []string) (*urlResult, error)
+
+// ruleEnv provides network access and run-wide settings to rules.
+type ruleEnv struct {
+	probe   *prober // used to check external sites
+	endDate date    // end date for relationships ended by generic rules; derived by the rule if empty
+
+	redirectMode  string   // redirect* value describing how the "redirect" rule updates URLs
+	redirectHosts []string // hosts that the "redirect" rule may follow cross-site redirects to
+	maxRedirects  int      // maximum redirects followed by the "redirect" rule
+}
+
+// Values for ruleEnv.redirectMode.
+const (
+	redirectRewrite = "rewrite" // edit the URL to its redirect target
+	redirectMigrate = "migrate" // end the URL's relationships and relate the targets to the redirect target
+)
+
+var allRedirectModes = []string{redirectRewrite, redirectMigrate}
+
+// entityChanged refetches info's entity from srv and returns true if its fingerprint changed.
+func entityChanged(ctx context.Context, srv *server, info *entityInfo) (bool, error) {
+	fresh, err := getFreshEntityInfo(ctx, srv, info.mbid, info.typ)
+	if err != nil {
+		return false, err
+	}
+	return fresh.fingerprint() != info.fingerprint(), nil
+}
+
+// overrideEndDates updates res so that relationships that were ended by the rule
+// that produced it end at d instead. New relationships that began when the
+// original relationships ended are updated to begin at d.
+func overrideEndDates(orig *entityInfo, res *urlResult, d date) {
+	wasEnded := make(map[int]bool, len(orig.rels))
+	for _, rel := range orig.rels {
+		wasEnded[rel.id] = rel.ended
+	}
+	handoffs := make(map[date]struct{})
+	for i := range res.updatedRels {
+		rel := &res.updatedRels[i]
+		if rel.ended && !wasEnded[rel.id] {
+			handoffs[rel.endDate] = struct{}{}
+			rel.endDate = d
+		}
+	}
+	for i := range res.newURLs {
+		for j := range res.newURLs[i].rels {
+			rel := &res.newURLs[i].rels[j]
+			if _, ok := handoffs[rel.beginDate]; ok {
+				rel.beginDate = d
+			}
+		}
+	}
+}
+
+// handOffRels adds changes to res to end orig's relationships at d. If newURL is non-empty,
+// copies of all of orig's relationships beginning at d are also added to newURL.
+func handOffRels(orig *entityInfo, newURL string, d date, res *urlResult) {
+	nu := entityInfo{name: newURL, typ: urlType}
+	for _, rel := range orig.rels {
+		old := rel
+		if !rel.ended {
+			rel.ended = true
+			rel.endDate = d
+			res.updatedRels = append(res.updatedRels, rel)
+		}
+		if newURL != "" {
+			newRel := old
+			newRel.id = 0
+			newRel.beginDate = d
+			newRel.endDate = date{}
+			newRel.ended = false
+			nu.rels = append(nu.rels, newRel)
+		}
+	}
+	if len(nu.rels) > 0 {
+		res.newURLs = append(res.newURLs, nu)
+	}
+}
+
+// sameSite returns true if hosts a and b (e.g. "www.example.org" and "example.org")
+// appear to belong to the same site.
+func sameSite(a, b string) bool {
+	a = strings.TrimPrefix(strings.ToLower(a), "www.")
+	b = strings.TrimPrefix(strings.ToLower(b), "www.")
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// urlMove describes relationships that are being moved from a URL to an existing URL.
+type urlMove struct {
+	to   entityInfo // existing URL; rels contains relationships to add to it
+	rels []relInfo  // original relationships to remove
+	adds []int      // index in to.rels for each of rels, or -1 if to already has an equivalent relationship
+}
+
+// urlRule describes how to process URLs matched by a regular expression.
+type urlRule struct {
+	name     string // short name used with -rule, e.g. "tidal"
+	re       *regexp.Regexp
+	fn       urlFunc    // receives re's match groups
+	netFn    netURLFunc // used instead of fn if non-nil
+	explicit bool       // only apply the rule if it's requested by name
+}
+
+// urlRuleNames returns the names of all rules in urlRules.
+func urlRuleNames() []string {
+	names := make([]string, len(urlRules))
+	for i, r := range urlRules {
+		names[i] = r.name
+	}
+	return names
+}
+
+// findURLRule returns the rule in urlRules with the supplied name, or nil if it doesn't exist.
+func findURLRule(name string) *urlRule {
+	for i := range urlRules {
+		if urlRules[i].name == name {
+			return &urlRules[i]
+		}
+	}
+	return nil
+}
+
 type urlResult struct {
 	rewritten   string    // rewritten URL
 	updatedRels []relInfo // relationships to update (others left unchanged)
 	newURLs     []entityInfo
-	editNote    string // https://musicbrainz.org/doc/Edit_Note
+	move        *urlMove // relationships to move to an existing URL
+	target      string   // URL found by the rule for edit notes, e.g. a redirect target
+	editNote    string   // https://musicbrainz.org/doc/Edit_Note; expanded by expandEditNote
+	flags       []string // reasons for flagging the URL for manual review; no edits are made if non-empty
 }
 
 const (
@@ -140,6 +617,9 @@ const (
 		"https://tickets.metabrainz.org/browse/MBBE-49"
 	operabaseEditNote  = "normalize Operabase artist URLs: https://tickets.metabrainz.org/browse/MBBE-76"
 	videogamInEditNote = "end Videogam.in relationships: https://tickets.metabrainz.org/browse/MBBE-77"
+	normalizeEditNote  = "normalize URL to canonical form: {{.Orig.Name}} -> {{.Rewritten}}"
+	deadLinkEditNote   = "end relationships for dead site: %v"
+	redirectEditNote   = "update URL to its permanent redirect target: {{.Orig.Name}} -> {{.Target}}"
 )
 
 var (
@@ -150,16 +630,23 @@ var (
 	videogamInEndDate     = date{2017, 5, 0}
 )
 
-var tidalAlbumTrackRegexp = regexp.MustCompile(`^/album/(\d+)/track/(\d+)$`)
+// purchaseForDownloadMap remaps URL relationships to "purchase for download".
+var purchaseForDownloadMap = mustNewLinkTypeMap(urlType, linkTypeMapping{
+	targets: []string{"artist", "release", "recording"},
+	to:      "purchase for download",
+})
 
-// missingTowerRecordsPairs contains [type, id] pairs for recmusic.jp URLs that don't work after
-// rewriting to music.tower.jp.
-var missingTowerRecordsPairs = map[[2]string]struct{}{
-	{"artist", "2001445271"}: struct{}{},
-	{"album", "1016070930"}:  struct{}{},
-}
+// Matchers used by rules to determine what URLs are attached to.
+var (
+	attachedToRecording = relMatcher{targets: []string{"recording"}}
+	attachedToRelease   = relMatcher{targets: []string{"release"}}
+)
+
+var tidalAlbumTrackRegexp = regexp.MustCompile(`^/album/(\d+)/track/(\d+)$`)
 
-var urlFuncs = map[*regexp.Regexp]urlFunc{
+// urlRules contains rules for processing URLs.
+// At most one rule is applied to each URL.
+var urlRules = []urlRule{
 	// MBBE-71: Normalize Tidal streaming URLs:
 	//  https://listen.tidal.com/album/114997210 -> https://tidal.com/album/114997210
 	//  https://listen.tidal.com/artist/11069    -> https://tidal.com/artist/11069
@@ -167,12 +654,12 @@ var urlFuncs = map[*regexp.Regexp]urlFunc{
 	//  https://tidal.com/browse/artist/5015356  -> https://tidal.com/artist/5015356
 	//  https://tidal.com/browse/track/120087531 -> https://tidal.com/track/120087531
 	//  (and many other forms)
-	regexp.MustCompile(`^https?://` + // both http:// and https://
+	{name: "tidal", re: regexp.MustCompile(`^https?://` + // both http:// and https://
 		`(?:(?:desktop\.|desktop\.stage\.|listen\.|www\.)?tidal\.com)` + // hostname
 		`(?:/browse)?` + // optional /browse component
 		`(/(?:album|artist|track|video|album/\d+/track)/\d+)` + // match significant components, e.g. /album/123
 		`(?:/|\?.*)?` + // trailing slash or query
-		`$`): func(orig *entityInfo, ms []string) *urlResult {
+		`$`), fn: func(orig *entityInfo, ms []string) *urlResult {
 		p := ms[1]
 		res := urlResult{
 			rewritten: "https://tidal.com" + p,
@@ -183,9 +670,9 @@ var urlFuncs = map[*regexp.Regexp]urlFunc{
 		// figure out what it should actually be.
 		if ms := tidalAlbumTrackRegexp.FindStringSubmatch(p); ms != nil {
 			album, track := ms[1], ms[2]
-			if len(filterRels(orig.rels, "recording")) > 0 {
+			if attachedToRecording.match(orig.rels) {
 				res.rewritten = "https://tidal.com/track/" + track
-			} else if len(filterRels(orig.rels, "release")) > 0 {
+			} else if attachedToRelease.match(orig.rels) {
 				res.rewritten = "https://tidal.com/album/" + album
 			} else {
 				return nil // give up if it's related to neither
@@ -193,13 +680,13 @@ var urlFuncs = map[*regexp.Regexp]urlFunc{
 		}
 
 		return &res
-	},
+	}},
 
 	// MBBE-47: Mark GeoCities URL relationships as ended.
-	regexp.MustCompile(`^https?://` + // both http:// and https://
+	{name: "geocities", re: regexp.MustCompile(`^https?://` + // both http:// and https://
 		`(?:[-a-z0-9]+\.)?geocities\.(?:yahoo\.)?(com|jp|co\.jp)` + // hostname (capture TLD)
 		`/.*` + // all paths
-		`$`): func(orig *entityInfo, ms []string) *urlResult {
+		`$`), fn: func(orig *entityInfo, ms []string) *urlResult {
 		res := urlResult{
 			rewritten: orig.name, // leave the URL alone
 			editNote:  geocitiesEditNote,
@@ -219,13 +706,13 @@ var urlFuncs = map[*regexp.Regexp]urlFunc{
 			return nil
 		}
 		return &res
-	},
+	}},
 
 	// MBBE-63: Mark Tidal Store URL relationships as ended.
-	regexp.MustCompile(`^https?://` +
+	{name: "tidal-store", re: regexp.MustCompile(`^https?://` +
 		`(store\.tidal\.com|tidal\.com(/[a-zA-Z]{2})?/store)` +
 		`/.*` +
-		`$`): func(orig *entityInfo, ms []string) *urlResult {
+		`$`), fn: func(orig *entityInfo, ms []string) *urlResult {
 		res := urlResult{
 			rewritten: orig.name, // leave the URL alone
 			editNote:  tidalStoreEditNote,
@@ -235,14 +722,7 @@ var urlFuncs = map[*regexp.Regexp]urlFunc{
 		// I've instead manually created edits to clean up the few URLs with multiple relationships.
 		for _, rel := range orig.rels {
 			old := rel
-			switch rel.targetType {
-			case "artist":
-				rel.linkTypeID = 176 // "music can be purchased for download at"
-			case "release":
-				rel.linkTypeID = 74 // "can be purchased for download at"
-			case "recording":
-				rel.linkTypeID = 254 // "can be purchased for download at"
-			}
+			rel.linkTypeID = purchaseForDownloadMap.remap(&rel)
 			if !rel.ended {
 				rel.ended = true
 				rel.endDate = tidalStoreEndDate
@@ -255,66 +735,36 @@ var urlFuncs = map[*regexp.Regexp]urlFunc{
 			return nil
 		}
 		return &res
-	},
+	}},
 
 	// MBBE-48: Mark RecMusic links as ended
 	// MBBE-49: Migrate RecMusic URLs to Tower Records Music URLs
-	regexp.MustCompile(`^https?://` +
-		`recmusic\.jp/(?:[a-z][a-z]/)?` + // hostname plus optional country code ("sp/")
-		`(artist|album)/\?id=(\d+)` + // capture entity type and numeric ID
-		`$`): func(orig *entityInfo, ms []string) *urlResult {
-		if len(orig.rels) == 0 {
-			return nil
-		}
-
-		res := urlResult{
-			rewritten: orig.name, // leave the URL alone
-			editNote:  recmusicEditNote,
-		}
-
-		newURL := entityInfo{
-			name: fmt.Sprintf("https://music.tower.jp/%s/detail/%s", ms[1], ms[2]),
-			typ:  urlType,
-		}
-		for _, rel := range orig.rels {
-			old := rel
-			if !rel.ended {
-				rel.ended = true
-				rel.endDate = recmusicEndDate
-			}
-			if rel != old {
-				res.updatedRels = append(res.updatedRels, rel)
-			}
-
-			if _, ok := missingTowerRecordsPairs[[2]string{ms[1], ms[2]}]; !ok {
-				newRel := old
-				newRel.id = 0
-				newRel.beginDate = recmusicEndDate
-				newRel.endDate = date{}
-				newRel.ended = false
-				newURL.rels = append(newURL.rels, newRel)
-			}
-		}
-		if len(newURL.rels) > 0 {
-			res.newURLs = append(res.newURLs, newURL)
-		}
-		return &res
-	},
+	migrationRule("recmusic", regexp.MustCompile(`^https?://`+
+		`recmusic\.jp/(?:[a-z][a-z]/)?`+ // hostname plus optional country code ("sp/")
+		`(artist|album)/\?id=(\d+)`+ // capture entity type and numeric ID
+		`$`), urlMigration{
+		target:      "https://music.tower.jp/$1/detail/$2",
+		date:        recmusicEndDate,
+		editNote:    recmusicEditNote,
+		exclude:     mustParseExclusions(recmusicExclusions),
+		copyAttrs:   true,
+		copyCredits: true,
+	}),
 
 	// MBBE-76: Normalize Operabase artist URLs:
 	//  https://operabase.com/a/mathieu-romano/22190 -> https://operabase.com/artists/22190
-	regexp.MustCompile(`^https?://` +
+	{name: "operabase", re: regexp.MustCompile(`^https?://` +
 		`(?:(?:www\.)?operabase\.com)` +
 		`/a/[^/]+/(\d+)` + // skip /a/artist-name/ and capture trailing integer ID
-		`$`): func(orig *entityInfo, ms []string) *urlResult {
+		`$`), fn: func(orig *entityInfo, ms []string) *urlResult {
 		return &urlResult{
 			rewritten: "https://operabase.com/artists/" + ms[1],
 			editNote:  operabaseEditNote,
 		}
-	},
+	}},
 
 	// MBBE-77: Mark Videogam.in relationships as ended.
-	regexp.MustCompile(`^https?://videogam\.in/`): func(orig *entityInfo, ms []string) *urlResult {
+	{name: "videogamin", re: regexp.MustCompile(`^https?://videogam\.in/`), fn: func(orig *entityInfo, ms []string) *urlResult {
 		res := urlResult{
 			rewritten: orig.name, // leave the URL alone
 			editNote:  videogamInEditNote,
@@ -330,5 +780,124 @@ var urlFuncs = map[*regexp.Regexp]urlFunc{
 			return nil
 		}
 		return &res
-	},
+	}},
+
+	// End relationships for URLs whose sites are confirmed to be dead.
+	// Only the site's root (e.g. "https://example.org/") is probed, not the URL itself.
+	// The end date is taken from -end-date or from the Last-Modified header of a 410 response.
+	// URLs are flagged rather than edited if neither is available.
+	{name: "dead-link", re: regexp.MustCompile(`^(https?)://([^/?#]+)`), explicit: true,
+		netFn: func(ctx context.Context, env *ruleEnv, orig *entityInfo, ms []string) (*urlResult, error) {
+			if len(filterEndedRels(orig.rels, false)) == 0 {
+				return nil, nil
+			}
+			pr, err := env.probe.probeSite(ctx, ms[1], ms[2])
+			if err != nil {
+				return nil, err
+			}
+			if !pr.dead() {
+				log.Printf("%v: %v", orig.mbid, pr)
+				return nil, nil
+			}
+			endDate := env.endDate
+			if endDate.empty() && !pr.lastModified.IsZero() {
+				t := pr.lastModified.UTC()
+				endDate = date{t.Year(), int(t.Month()), t.Day()}
+			}
+			if endDate.empty() {
+				return &urlResult{
+					rewritten: orig.name, // leave the URL alone
+					flags:     []string{fmt.Sprintf("%v but end date is unknown (supply -end-date)", pr)},
+				}, nil
+			}
+			res := urlResult{
+				rewritten: orig.name, // leave the URL alone
+				editNote:  fmt.Sprintf(deadLinkEditNote, pr),
+			}
+			for _, rel := range orig.rels {
+				if !rel.ended {
+					rel.ended = true
+					rel.endDate = endDate
+					res.updatedRels = append(res.updatedRels, rel)
+				}
+			}
+			return &res, nil
+		}},
+
+	// Update URLs that permanently redirect to a different location, either by rewriting them
+	// or by ending their relationships and adding equivalent relationships to the new URL.
+	// Cross-site redirects are only followed to hosts listed in -redirect-hosts.
+	{name: "redirect", re: regexp.MustCompile(`^https?://([^/?#]+)`), explicit: true,
+		netFn: func(ctx context.Context, env *ruleEnv, orig *entityInfo, ms []string) (*urlResult, error) {
+			final, err := env.probe.followRedirects(ctx, orig.name, env.maxRedirects)
+			if err != nil {
+				return nil, err
+			} else if final == orig.name {
+				return nil, nil
+			}
+			ou, err := url.Parse(orig.name)
+			if err != nil {
+				return nil, err
+			}
+			pu, err := url.Parse(final)
+			if err != nil {
+				return nil, err
+			}
+			if !sameSite(ms[1], pu.Host) && !sliceContains(env.redirectHosts, strings.ToLower(pu.Host)) {
+				log.Printf("%v: not following cross-site redirect to %v", orig.mbid, final)
+				return nil, nil
+			}
+			if isFallbackRedirect(ou, pu) {
+				log.Printf("%v: not following redirect to homepage or login page %v", orig.mbid, final)
+				return nil, nil
+			}
+
+			res := urlResult{target: final, editNote: redirectEditNote}
+			if env.redirectMode == redirectMigrate {
+				if len(filterEndedRels(orig.rels, false)) == 0 {
+					return nil, nil
+				}
+				d := env.endDate
+				if d.empty() {
+					now := time.Now()
+					d = date{now.Year(), int(now.Month()), now.Day()}
+				}
+				res.rewritten = orig.name // leave the URL alone
+				handOffRels(&entityInfo{rels: filterEndedRels(orig.rels, false)}, final, d, &res)
+			} else {
+				res.rewritten = final
+			}
+			return &res, nil
+		}},
+
+	// Flag Bandcamp track URLs that are attached to releases rather than recordings.
+	// Other Bandcamp track URLs are left alone; use -rule normalize to clean them up.
+	{name: "bandcamp", re: regexp.MustCompile(`^https?://` +
+		`[-a-z0-9]+\.bandcamp\.com` + // artist hostname
+		`/track/`), fn: func(orig *entityInfo, ms []string) *urlResult {
+		if attachedToRelease.match(orig.rels) {
+			return &urlResult{
+				rewritten: orig.name, // leave the URL alone
+				flags:     []string{"Bandcamp track URL is attached to release"},
+			}
+		}
+		return nil
+	}},
+
+	// Normalize URLs that weren't handled by an earlier rule using the normalize package,
+	// e.g. https://m.soundcloud.com/artist/ -> https://soundcloud.com/artist.
+	// This matches all URLs, so it must be requested explicitly.
+	{name: "normalize", re: regexp.MustCompile(`^https?://`), explicit: true, fn: normalizeURL},
+}
+
+// normalizeURL is a urlFunc that rewrites orig to the canonical form returned by normalize.URL.
+func normalizeURL(orig *entityInfo, ms []string) *urlResult {
+	canon, err := normalize.URL(orig.name)
+	if err != nil || canon == orig.name {
+		return nil
+	}
+	return &urlResult{
+		rewritten: canon,
+		editNote:  normalizeEditNote,
+	}
 }
@@ -5,11 +5,17 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"net/url"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/time/rate"
 )
 
 func TestProcessURL(t *testing.T) {
@@ -57,8 +63,8 @@ func TestProcessURL(t *testing.T) {
 		videogamInMBID,
 		doneMBID,
 	} {
-		if err := processURL(ctx, env.srv, mbid, "", false); err != nil {
-			t.Errorf("processURL(ctx, srv, %q, %q, false) failed: %v", mbid, "", err)
+		if err := processURL(ctx, env.srv, mbid, &urlOptions{}); err != nil {
+			t.Errorf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
 		}
 	}
 	want := []request{
@@ -149,6 +155,416 @@ func TestProcessURL(t *testing.T) {
 	}
 }
 
+func TestProcessURL_EditNote(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		tidalMBID     = "40d2c699-f615-4f95-b212-24c344572333"
+		geocitiesMBID = "56313079-1796-4fb8-add5-d8cf117f3ba5"
+	)
+	env.mbidURLs[tidalMBID] = "http://listen.tidal.com/artist/11069"
+	env.mbidURLs[geocitiesMBID] = "http://www.geocities.com/user"
+	env.mbidRels[geocitiesMBID] = []jsonRelationship{{ID: 123, LinkTypeID: 3}}
+
+	opts := urlOptions{editNote: "was {{.Orig.Name}}", appendEditNote: true}
+	if err := processURL(ctx, env.srv, tidalMBID, &opts); err != nil {
+		t.Errorf("processURL(ctx, srv, %q, %+v) failed: %v", tidalMBID, opts, err)
+	}
+	opts = urlOptions{editNote: "{{range .UpdatedRels}}{{.ID}} ends {{.EndDate}}{{end}}"}
+	if err := processURL(ctx, env.srv, geocitiesMBID, &opts); err != nil {
+		t.Errorf("processURL(ctx, srv, %q, %+v) failed: %v", geocitiesMBID, opts, err)
+	}
+	opts = urlOptions{editNote: "{{.Bogus}}"}
+	if err := processURL(ctx, env.srv, tidalMBID, &opts); err == nil {
+		t.Errorf("processURL(ctx, srv, %q, %+v) unexpectedly succeeded", tidalMBID, opts)
+	}
+
+	var got []string
+	for _, req := range env.requests {
+		got = append(got, req.params.Get("edit-url.edit_note")+req.params.Get("rel-editor.edit_note"))
+	}
+	want := []string{
+		tidalEditNote + "\n\nwas http://listen.tidal.com/artist/11069",
+		"123 ends 2009-10-26",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("Bad edit notes:\n" + diff)
+	}
+}
+
+func TestProcessURL_ExistingURL(t *testing.T) {
+	const (
+		oldMBID      = "40d2c699-f615-4f95-b212-24c344572333"
+		existingMBID = "e9ce6782-29e6-4f09-82b0-0abd18061e32"
+		artistMBID   = "63a5c79f-697e-47e0-975d-1e2087a454aa"
+		releaseMBID  = "4e135691-fdc1-4127-ab69-67095aa09c44"
+	)
+
+	for _, tc := range []struct {
+		strategy string
+		want     []request
+	}{
+		{existingURLSkip, nil},
+		{existingURLMerge, []request{{
+			path: "/url/" + oldMBID + "/edit",
+			params: makeURLValues(map[string]string{
+				"edit-url.url": "https://tidal.com/album/1234",
+				"edit-url.edit_note": tidalEditNote + "\n\nhttps://tidal.com/album/1234 already exists as " +
+					"SERVER/url/" + existingMBID + ", so this edit merges the two URLs.",
+			}),
+		}}},
+		{existingURLMove, []request{
+			{
+				path: "/relationship-editor",
+				params: makeURLValues(map[string]string{
+					"rel-editor.edit_note": tidalEditNote + "\n\nMoving relationships to existing URL " +
+						"SERVER/url/" + existingMBID + ".",
+					"rel-editor.rels.0.action":        "add",
+					"rel-editor.rels.0.link_type":     "980",
+					"rel-editor.rels.0.entity.0.gid":  releaseMBID,
+					"rel-editor.rels.0.entity.0.type": "release",
+					"rel-editor.rels.0.entity.1.url":  "https://tidal.com/album/1234",
+					"rel-editor.rels.0.entity.1.type": "url",
+				}),
+			},
+			{
+				path: "/relationship-editor",
+				params: makeURLValues(map[string]string{
+					"rel-editor.edit_note": tidalEditNote + "\n\nMoving relationships to existing URL " +
+						"SERVER/url/" + existingMBID + ".",
+					"rel-editor.rels.0.action":    "remove",
+					"rel-editor.rels.0.id":        "1",
+					"rel-editor.rels.0.link_type": "978",
+					"rel-editor.rels.1.action":    "remove",
+					"rel-editor.rels.1.id":        "2",
+					"rel-editor.rels.1.link_type": "980",
+				}),
+			},
+		}},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			ctx := context.Background()
+			env := newTestEnv(ctx, t)
+			defer env.close()
+
+			env.mbidURLs[oldMBID] = "https://listen.tidal.com/album/1234"
+			env.mbidURLs[existingMBID] = "https://tidal.com/album/1234"
+			env.mbidRels[oldMBID] = []jsonRelationship{
+				{ID: 1, LinkTypeID: 978, Target: jsonTarget{EntityType: "artist", GID: artistMBID}, Backward: true},
+				{ID: 2, LinkTypeID: 980, Target: jsonTarget{EntityType: "release", GID: releaseMBID}, Backward: true},
+			}
+			env.mbidRels[existingMBID] = []jsonRelationship{
+				{ID: 3, LinkTypeID: 978, Target: jsonTarget{EntityType: "artist", GID: artistMBID}, Backward: true},
+			}
+
+			opts := urlOptions{existingURL: tc.strategy}
+			if err := processURL(ctx, env.srv, oldMBID, &opts); err != nil {
+				t.Fatalf("processURL(ctx, srv, %q, %+v) failed: %v", oldMBID, opts, err)
+			}
+			for _, req := range tc.want {
+				for k, vs := range req.params {
+					for i, v := range vs {
+						vs[i] = strings.ReplaceAll(v, "SERVER", env.testSrv.URL)
+					}
+					req.params[k] = vs
+				}
+			}
+			if diff := cmp.Diff(tc.want, env.requests, cmp.AllowUnexported(request{})); diff != "" {
+				t.Error("Bad requests:\n" + diff)
+			}
+		})
+	}
+}
+
+func TestProcessURL_MoveFailedAdd(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		oldMBID      = "40d2c699-f615-4f95-b212-24c344572333"
+		existingMBID = "e9ce6782-29e6-4f09-82b0-0abd18061e32"
+		artistMBID   = "63a5c79f-697e-47e0-975d-1e2087a454aa"
+		releaseMBID  = "4e135691-fdc1-4127-ab69-67095aa09c44"
+		recMBID      = "0c3e2d9b-9e8f-4e0f-8d8a-4c8b6f0a1f2e"
+	)
+	env.mbidURLs[oldMBID] = "https://listen.tidal.com/album/1234"
+	env.mbidURLs[existingMBID] = "https://tidal.com/album/1234"
+	env.mbidRels[oldMBID] = []jsonRelationship{
+		{ID: 1, LinkTypeID: 978, Target: jsonTarget{EntityType: "artist", GID: artistMBID}, Backward: true},
+		{ID: 2, LinkTypeID: 980, Target: jsonTarget{EntityType: "release", GID: releaseMBID}, Backward: true},
+		{ID: 3, LinkTypeID: 979, Target: jsonTarget{EntityType: "recording", GID: recMBID}, Backward: true},
+	}
+	env.mbidRels[existingMBID] = []jsonRelationship{
+		{ID: 4, LinkTypeID: 978, Target: jsonTarget{EntityType: "artist", GID: artistMBID}, Backward: true},
+	}
+	env.relResponses = map[string]int{releaseMBID: 0}
+
+	// The release relationship couldn't be added, so it should be left on the old URL.
+	var report strings.Builder
+	opts := urlOptions{existingURL: existingURLMove, report: newReporter(&report)}
+	if err := processURL(ctx, env.srv, oldMBID, &opts); err != nil {
+		t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", oldMBID, err)
+	}
+	var removed []string
+	for _, req := range env.requests {
+		vals := flattenValues(req.params)
+		for i := 0; i < countRelEdits(vals); i++ {
+			if pre := relEditPrefix + strconv.Itoa(i) + "."; vals[pre+"action"] == "remove" {
+				removed = append(removed, vals[pre+"id"])
+			}
+		}
+	}
+	if diff := cmp.Diff([]string{"1", "3"}, removed); diff != "" {
+		t.Error("Bad removed relationships:\n" + diff)
+	}
+	if !strings.Contains(report.String(), oldMBID+"\t"+reportFailed+"\t") {
+		t.Errorf("Report is %q; want %v line for %v", report.String(), reportFailed, oldMBID)
+	}
+}
+
+func TestProcessURL_MoveInvalidDates(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		oldMBID      = "40d2c699-f615-4f95-b212-24c344572333"
+		existingMBID = "e9ce6782-29e6-4f09-82b0-0abd18061e32"
+		releaseMBID  = "4e135691-fdc1-4127-ab69-67095aa09c44"
+	)
+	env.mbidURLs[oldMBID] = "https://listen.tidal.com/album/1234"
+	env.mbidURLs[existingMBID] = "https://tidal.com/album/1234"
+	env.mbidRels[oldMBID] = []jsonRelationship{{ID: 1, LinkTypeID: 980, BeginDate: jsonDate{2015, 2, 30},
+		Target: jsonTarget{EntityType: "release", GID: releaseMBID}, Backward: true}}
+
+	// The relationship shouldn't be removed from the old URL if it can't be added to the existing one.
+	var report strings.Builder
+	opts := urlOptions{existingURL: existingURLMove, report: newReporter(&report)}
+	if err := processURL(ctx, env.srv, oldMBID, &opts); err != nil {
+		t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", oldMBID, err)
+	}
+	if len(env.requests) != 0 {
+		t.Errorf("processURL sent requests %+v; want none", env.requests)
+	}
+	if !strings.Contains(report.String(), oldMBID+"\t"+reportSkipped+"\t") {
+		t.Errorf("Report is %q; want %v line for %v", report.String(), reportSkipped, oldMBID)
+	}
+}
+
+func TestProcessURL_InvalidDates(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const mbid = "56313079-1796-4fb8-add5-d8cf117f3ba5"
+	env.mbidURLs[mbid] = "http://www.geocities.com/user"
+	env.mbidRels[mbid] = []jsonRelationship{
+		{ID: 123, LinkTypeID: 3},
+		{ID: 456, LinkTypeID: 7, BeginDate: jsonDate{2010, 4, 5}}, // after GeoCities shutdown
+	}
+
+	var report strings.Builder
+	opts := urlOptions{report: newReporter(&report)}
+	if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+		t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+	}
+	want := []request{{
+		path: "/relationship-editor",
+		params: makeURLValues(map[string]string{
+			"rel-editor.edit_note":                    geocitiesEditNote,
+			"rel-editor.rels.0.action":                "edit",
+			"rel-editor.rels.0.id":                    "123",
+			"rel-editor.rels.0.link_type":             "3",
+			"rel-editor.rels.0.period.ended":          "1",
+			"rel-editor.rels.0.period.end_date.day":   "26",
+			"rel-editor.rels.0.period.end_date.month": "10",
+			"rel-editor.rels.0.period.end_date.year":  "2009",
+		}),
+	}}
+	if diff := cmp.Diff(want, env.requests, cmp.AllowUnexported(request{})); diff != "" {
+		t.Error("Bad requests:\n" + diff)
+	}
+	if got := report.String(); !strings.HasPrefix(got, mbid+"\t"+reportInvalid+"\t") {
+		t.Errorf("Report is %q; want %v line", got, reportInvalid)
+	}
+}
+
+func TestProcessURL_ChangedConcurrently(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const mbid = "56313079-1796-4fb8-add5-d8cf117f3ba5"
+	env.mbidURLs[mbid] = "http://www.geocities.com/user"
+	env.mbidRels[mbid] = []jsonRelationship{{ID: 123, LinkTypeID: 3}}
+
+	// End the relationship after the URL is first fetched.
+	var fetches int
+	env.getHook = func(req *http.Request) {
+		if req.URL.Path == "/url/"+mbid+"/edit" {
+			if fetches++; fetches == 2 {
+				env.mbidRels[mbid][0].Ended = true
+			}
+		}
+	}
+
+	var report strings.Builder
+	opts := urlOptions{report: newReporter(&report)}
+	if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+		t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+	}
+	if len(env.requests) != 0 {
+		t.Errorf("processURL sent %v; want no requests", env.requests)
+	}
+	if got := report.String(); !strings.HasPrefix(got, mbid+"\t"+reportChanged+"\t") {
+		t.Errorf("Report is %q; want %v line", got, reportChanged)
+	}
+
+	// If the URL was fetched recently, it shouldn't be refetched.
+	fetches = 0
+	env.mbidRels[mbid][0].Ended = false
+	opts.verifyAfter = time.Minute
+	if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+		t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+	}
+	if fetches != 1 || len(env.requests) != 1 {
+		t.Errorf("processURL fetched URL %d time(s) and sent %d request(s); want 1 and 1", fetches, len(env.requests))
+	}
+}
+
+func TestProcessURL_SkipOpenEdits(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		mbid1 = "11111111-1111-1111-1111-111111111111"
+		mbid2 = "22222222-2222-2222-2222-222222222222"
+	)
+	env.mbidURLs[mbid1] = "https://listen.tidal.com/artist/1"
+	env.mbidURLs[mbid2] = "https://listen.tidal.com/artist/2"
+	env.urlOpenEdits[mbid1] = 2
+
+	var report, deferred strings.Builder
+	opts := urlOptions{skipOpenEdits: true, report: newReporter(&report)}
+	for _, mbid := range []string{mbid1, mbid2} {
+		if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+			t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+		}
+	}
+	if len(env.requests) != 1 || env.requests[0].path != "/url/"+mbid2+"/edit" {
+		t.Errorf("processURL sent %v; want single edit for %v", env.requests, mbid2)
+	}
+	if got := report.String(); !strings.HasPrefix(got, mbid1+"\t"+reportSkipped+"\t") {
+		t.Errorf("Report is %q; want %v line", got, reportSkipped)
+	}
+
+	report.Reset()
+	opts.deferred = &deferred
+	if err := processURL(ctx, env.srv, mbid1, &opts); err != nil {
+		t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid1, err)
+	}
+	if got := report.String(); !strings.HasPrefix(got, mbid1+"\t"+reportDeferred+"\t") {
+		t.Errorf("Report is %q; want %v line", got, reportDeferred)
+	}
+	if got := deferred.String(); got != mbid1+"\n" {
+		t.Errorf("Deferred %q; want %q", got, mbid1+"\n")
+	}
+}
+
+func TestOverrideEndDates(t *testing.T) {
+	orig := entityInfo{name: "https://recmusic.jp/artist/?id=123", typ: urlType, rels: []relInfo{
+		{id: 1, linkTypeID: 978, targetType: "artist"},
+		{id: 2, linkTypeID: 978, targetType: "artist", ended: true, endDate: date{2003, 0, 0}},
+	}}
+	res, err := runURLFunc(context.Background(), nil, &orig, "recmusic")
+	if err != nil || res == nil {
+		t.Fatalf("runURLFunc(ctx, nil, %v, %q) = %v, %v", orig, "recmusic", res, err)
+	}
+	d := date{2020, 12, 31}
+	overrideEndDates(&orig, res, d)
+	if want := []relInfo{{id: 1, linkTypeID: 978, targetType: "artist", ended: true, endDate: d}}; !reflect.DeepEqual(res.updatedRels, want) {
+		t.Errorf("Updated rels are %v; want %v", res.updatedRels, want)
+	}
+	want := []relInfo{
+		{linkTypeID: 978, targetType: "artist", beginDate: d},
+		{linkTypeID: 978, targetType: "artist", beginDate: d},
+	}
+	if len(res.newURLs) != 1 || !reflect.DeepEqual(res.newURLs[0].rels, want) {
+		t.Errorf("New URLs are %v; want rels %v", res.newURLs, want)
+	}
+}
+
+func TestProcessURL_Archive(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const mbid = "56313079-1796-4fb8-add5-d8cf117f3ba5"
+	env.mbidURLs[mbid] = "http://www.geocities.com/user"
+	env.mbidRels[mbid] = []jsonRelationship{{ID: 123, LinkTypeID: 3}}
+
+	for _, tc := range []struct {
+		snapshot string
+		want     string
+	}{
+		{"20091020123456", geocitiesEditNote +
+			"\n\nArchived copy: http://web.archive.org/web/20091020123456/http://www.geocities.com/user"},
+		{"20091027000000", geocitiesEditNote}, // after end date
+		{"", geocitiesEditNote},               // no snapshots
+	} {
+		env.snapshot = tc.snapshot
+		env.requests = nil
+		opts := urlOptions{archiveURL: env.testSrv.URL, probe: newProber(rate.Inf)}
+		if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+			t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+		}
+		if len(env.requests) != 1 {
+			t.Errorf("Got %d request(s) for snapshot %q; want 1", len(env.requests), tc.snapshot)
+		} else if got := env.requests[0].params.Get("rel-editor.edit_note"); got != tc.want {
+			t.Errorf("Edit note for snapshot %q is %q; want %q", tc.snapshot, got, tc.want)
+		}
+	}
+}
+
+func TestProcessURL_LinkTypeWithoutDates(t *testing.T) {
+	orig := linkTypes
+	defer func() {
+		linkTypes = orig
+		if err := rebuildLinkTypeMaps(); err != nil {
+			t.Error("Rebuilding with original link types failed:", err)
+		}
+	}()
+	// Load a catalog with a link type that doesn't support dates the same way that -link-types does.
+	if err := useLinkTypes(filepath.Join("testdata", "mbdump")); err != nil {
+		t.Fatal("Failed loading link types:", err)
+	}
+
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const mbid = "56313079-1796-4fb8-add5-d8cf117f3ba5"
+	env.mbidURLs[mbid] = "http://www.geocities.com/user"
+	env.mbidRels[mbid] = []jsonRelationship{{ID: 123, LinkTypeID: 9001}}
+
+	var report strings.Builder
+	opts := urlOptions{report: newReporter(&report)}
+	if err := processURL(ctx, env.srv, mbid, &opts); err != nil {
+		t.Fatalf("processURL(ctx, srv, %q, ...) failed: %v", mbid, err)
+	}
+	if len(env.requests) != 0 {
+		t.Errorf("processURL sent %d request(s); want 0", len(env.requests))
+	}
+	if got := report.String(); !strings.HasPrefix(got, mbid+"\t"+reportInvalid+"\t") ||
+		!strings.Contains(got, "doesn't support dates") {
+		t.Errorf("Report is %q; want %v line about dates", got, reportInvalid)
+	}
+}
+
 func makeURLValues(m map[string]string) url.Values {
 	vals := make(url.Values)
 	for k, v := range m {
@@ -158,115 +574,54 @@ func makeURLValues(m map[string]string) url.Values {
 }
 
 func TestRunURLFunc(t *testing.T) {
-	d := date{2003, 7, 9} // arbitrary
-
+	// Individual rules are exercised by the fixtures checked by TestRuleFixtures.
+	// URLs that aren't matched by any non-explicit rule should be left alone.
 	for _, tc := range []struct {
-		url         string
-		rels        []relInfo
-		rewritten   string // rewritten URL; "" means no rewrite
-		updatedRels []relInfo
-		newURLs     []entityInfo
+		url  string
+		rels []relInfo
 	}{
-		{"https://www.example.org/", nil, "", nil, nil},
-		{"https://www.example.org/artist/123", nil, "", nil, nil},
-		{"https://www.example.org/", []relInfo{{targetType: "release"}}, "", nil, nil},
-
-		// Tidal (MBBE-71)
-		{"https://tidal.com/album/11069", nil, "", nil, nil},      // already canonicalized
-		{"https://test.tidal.com/album/11069", nil, "", nil, nil}, // unknown hostname
-		{"http://www.tidal.com/test/11069", nil, "", nil, nil},    // unknown path component
-		{"http://tidal.com/album/11069", nil, "https://tidal.com/album/11069", nil, nil},
-		{"https://listen.tidal.com/artist/11069", nil, "https://tidal.com/artist/11069", nil, nil},
-		{"https://tidal.com/browse/track/11069", nil, "https://tidal.com/track/11069", nil, nil},
-		{"https://www.tidal.com/album/11069", nil, "https://tidal.com/album/11069", nil, nil},
-		{"https://listen.tidal.com/album/123/track/456", []relInfo{{targetType: "release"}},
-			"https://tidal.com/album/123", nil, nil},
-		{"https://listen.tidal.com/album/123/track/456", []relInfo{{targetType: "recording"}},
-			"https://tidal.com/track/456", nil, nil},
-		{"https://listen.tidal.com/album/123/track/456", []relInfo{{targetType: "release"}, {targetType: "recording"}},
-			"https://tidal.com/track/456", nil, nil},
-		{"https://listen.tidal.com/album/123/track/456", []relInfo{{targetType: "artist"}}, "", nil, nil},
-		{"https://desktop.tidal.com/album/163812859", nil, "https://tidal.com/album/163812859", nil, nil},
-		{"http://tidal.com/browse/album/119425271?play=true", nil, "https://tidal.com/album/119425271", nil, nil},
-		{"https://tidal.com/browse/album/126495793/", nil, "https://tidal.com/album/126495793", nil, nil},
-		{"https://listen.tidal.com/video/78581329", nil, "https://tidal.com/video/78581329", nil, nil},
-		{"https://www.tidal.com/browse/track/155221653", nil, "https://tidal.com/track/155221653", nil, nil},
-
-		// GeoCities (MBBE-47)
-		{"http://www.geocities.com/test/", nil, "", nil, nil}, // no relationships
-		{"http://www.geocities.com/test/", []relInfo{{targetType: "artist", ended: true, endDate: d}},
-			"", nil, nil}, // already ended
-		{"http://www.geocities.com/test/", []relInfo{{targetType: "artist", beginDate: d}},
-			"", []relInfo{{targetType: "artist", beginDate: d, ended: true, endDate: geocitiesEndDate}}, nil},
-		{"http://geocities.yahoo.co.jp/test/", []relInfo{{targetType: "artist", beginDate: d}, {targetType: "release", beginDate: d}},
-			"", []relInfo{
-				{targetType: "artist", beginDate: d, ended: true, endDate: geocitiesJapanEndDate},
-				{targetType: "release", beginDate: d, ended: true, endDate: geocitiesJapanEndDate},
-			}, nil},
-
-		// Tidal Store (MBBE-63)
-		{"https://store.tidal.com/artist/123", nil, "", nil, nil}, // no relationships
-		{"https://store.tidal.com/artist/123", []relInfo{{targetType: "artist", linkTypeID: 176, ended: true, endDate: d}},
-			"", nil, nil}, // already ended
-		{"https://store.tidal.com/artist/123", []relInfo{{targetType: "artist", linkTypeID: 176}},
-			"", []relInfo{{targetType: "artist", linkTypeID: 176, ended: true, endDate: tidalStoreEndDate}}, nil},
-		{"https://store.tidal.com/artist/123", []relInfo{{targetType: "artist", linkTypeID: 194, ended: true, endDate: d}},
-			"", []relInfo{{targetType: "artist", linkTypeID: 176, ended: true, endDate: d}}, nil},
-		{"https://tidal.com/store/album/123", []relInfo{{targetType: "release", linkTypeID: 85}},
-			"", []relInfo{{targetType: "release", linkTypeID: 74, ended: true, endDate: tidalStoreEndDate}}, nil},
-		{"https://tidal.com/us/store/track/123", []relInfo{{targetType: "recording", linkTypeID: 268}},
-			"", []relInfo{{targetType: "recording", linkTypeID: 254, ended: true, endDate: tidalStoreEndDate}}, nil},
-
-		// RecMusic (MBBE-48) and Tower Records Music (MBBE-49)
-		{"https://recmusic.jp/album/?id=1010526534", nil, "", nil, nil}, // no relationships
-		{"https://recmusic.jp/album/?id=1010526534", []relInfo{{targetType: "release", linkTypeID: 980, ended: true, endDate: d}},
-			"", nil, []entityInfo{{
-				typ:  urlType,
-				name: "https://music.tower.jp/album/detail/1010526534",
-				rels: []relInfo{{targetType: "release", linkTypeID: 980, beginDate: recmusicEndDate}},
-			}}}, // already ended
-		{"https://recmusic.jp/artist/?id=2000017248", []relInfo{{targetType: "artist", linkTypeID: 978}},
-			"", []relInfo{{targetType: "artist", linkTypeID: 978, endDate: recmusicEndDate, ended: true}},
-			[]entityInfo{{
-				typ:  urlType,
-				name: "https://music.tower.jp/artist/detail/2000017248",
-				rels: []relInfo{{targetType: "artist", linkTypeID: 978, beginDate: recmusicEndDate}},
-			}}},
-		{"https://recmusic.jp/artist/?id=2001445271", []relInfo{{targetType: "artist", linkTypeID: 978}},
-			"", []relInfo{{targetType: "artist", linkTypeID: 978, endDate: recmusicEndDate, ended: true}}, nil}, // no longer active
-
-		// Operabase (MBBE-76)
-		{"https://operabase.com/artists/55012", nil, "", nil, nil}, // already canonicalized
-		{"https://operabase.com/a/frank-boonen/55012", nil, "https://operabase.com/artists/55012", nil, nil},
-		{"https://www.operabase.com/a/tobias-w%C3%B6gerer/93710", nil, "https://operabase.com/artists/93710", nil, nil},
-
-		// Videogam.in (MBBE-77)
-		{"http://videogam.in/music/?id=3TP-0032K", nil, "", nil, nil}, // no relationships
-		{"http://videogam.in/music/?id=3TP-0032K", []relInfo{{targetType: "artist", linkTypeID: 82, ended: true, endDate: d}},
-			"", nil, nil}, // already ended
-		{"http://videogam.in/music/?id=3TP-0032K", []relInfo{{targetType: "artist", linkTypeID: 82}},
-			"", []relInfo{{targetType: "artist", linkTypeID: 82, ended: true, endDate: videogamInEndDate}}, nil},
+		{"https://www.example.org/", nil},
+		{"https://www.example.org/artist/123", nil},
+		{"https://www.example.org/", []relInfo{{targetType: "release"}}},
 	} {
-		if tc.rewritten == "" {
-			tc.rewritten = tc.url
-		}
 		orig := entityInfo{name: tc.url, rels: tc.rels, typ: urlType}
-		res := runURLFunc(&orig)
-		if res == nil {
-			if tc.rewritten != tc.url || len(tc.updatedRels) > 0 || len(tc.newURLs) > 0 {
-				t.Errorf("runURLFunc(%v) didn't rewrite; want %q, %v, %v", orig, tc.rewritten, tc.updatedRels, tc.newURLs)
-			}
-			continue
+		if res, err := runURLFunc(context.Background(), nil, &orig, ""); err != nil {
+			t.Errorf("runURLFunc(%v) failed: %v", orig, err)
+		} else if res != nil {
+			t.Errorf("runURLFunc(%v) = %+v; want nil", orig, res)
 		}
+	}
+}
 
-		if res.rewritten != tc.rewritten {
-			t.Errorf("runURLFunc(%v) rewrote URL to %q; want %q", orig, res.rewritten, tc.rewritten)
-		}
-		if !reflect.DeepEqual(res.updatedRels, tc.updatedRels) {
-			t.Errorf("runURLFunc(%v) updated rels %v; want %v", orig, res.updatedRels, tc.updatedRels)
-		}
-		if !reflect.DeepEqual(res.newURLs, tc.newURLs) {
-			t.Errorf("runURLFunc(%v) added URLs %v; want %v", orig, res.newURLs, tc.newURLs)
-		}
+func TestRunURLFunc_Rule(t *testing.T) {
+	orig := entityInfo{name: "https://listen.tidal.com/artist/11069", typ: urlType}
+	ctx := context.Background()
+	if res, err := runURLFunc(ctx, nil, &orig, "operabase"); err != nil || res != nil {
+		t.Errorf("runURLFunc(%v, %q) = %+v, %v; want nil", orig, "operabase", res, err)
+	}
+	const want = "https://tidal.com/artist/11069"
+	if res, err := runURLFunc(ctx, nil, &orig, "tidal"); err != nil || res == nil || res.rewritten != want {
+		t.Errorf("runURLFunc(%v, %q) = %+v, %v; want %q", orig, "tidal", res, err, want)
+	}
+
+	// The normalize rule matches all URLs, so it should only be used when requested.
+	tracked := entityInfo{name: "https://www.example.org/artist/123?utm_source=newsletter", typ: urlType}
+	if res, err := runURLFunc(ctx, nil, &tracked, ""); err != nil || res != nil {
+		t.Errorf("runURLFunc(%v, %q) = %+v, %v; want nil", tracked, "", res, err)
+	}
+	const wantNorm = "https://www.example.org/artist/123"
+	if res, err := runURLFunc(ctx, nil, &tracked, "normalize"); err != nil || res == nil || res.rewritten != wantNorm {
+		t.Errorf("runURLFunc(%v, %q) = %+v, %v; want %q", tracked, "normalize", res, err, wantNorm)
+	}
+}
+
+func TestRuleFixtures(t *testing.T) {
+	dir := filepath.Join("testdata", "rules")
+	n, errs := checkRuleFixtures(dir)
+	if n == 0 {
+		t.Errorf("No fixtures found in %v", dir)
+	}
+	for _, err := range errs {
+		t.Error(err)
 	}
 }
@@ -0,0 +1,248 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// URL-related edit types returned by the edit search.
+const (
+	editTypeAddRel  = 90  // "Add relationship"
+	editTypeEditRel = 91  // "Edit relationship"
+	editTypeEditURL = 101 // "Edit URL"
+)
+
+// maxWatchPages is the maximum number of edit search pages that are fetched by a single poll.
+// Any remaining edits are fetched by the next poll.
+const maxWatchPages = 10
+
+// watchOptions configures watchURLs.
+type watchOptions struct {
+	statePath string        // JSON file used to persist watchState between polls and runs
+	interval  time.Duration // time between polls
+	urlOpts   *urlOptions   // passed to processURL
+}
+
+// watchState is persisted between polls.
+type watchState struct {
+	LastEditID int `json:"lastEditId"` // newest edit that has been processed
+}
+
+// loadWatchState reads a watchState from the file at p.
+// The returned bool is false if the file doesn't exist.
+func loadWatchState(p string) (watchState, bool, error) {
+	var st watchState
+	b, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return st, false, nil
+	} else if err != nil {
+		return st, false, err
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return st, false, fmt.Errorf("%v: %v", p, err)
+	}
+	return st, true, nil
+}
+
+// saveWatchState atomically writes st to the file at p.
+func saveWatchState(p string, st watchState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// watchURLs polls srv for URL-related edits every opts.interval and processes the
+// affected URLs until ctx is canceled or an edit limit is reached.
+func watchURLs(ctx context.Context, srv *server, opts *watchOptions) error {
+	log.Printf("Watching for URL edits every %v", opts.interval)
+	for {
+		start := time.Now()
+		if n, err := pollURLEdits(ctx, srv, opts); isLimitErr(err) {
+			return err
+		} else if err != nil && ctx.Err() == nil {
+			log.Printf("Poll failed after processing %d URL(s): %v", n, err)
+		} else if err == nil {
+			log.Printf("Poll processed %d URL(s) in %v", n, time.Since(start).Round(time.Millisecond))
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Print("Stopping watch: ", ctx.Err())
+			return nil
+		case <-time.After(opts.interval):
+		}
+	}
+}
+
+// pollURLEdits processes URLs affected by edits that were made since the
+// last poll and updates the state file. The number of URLs is returned.
+// If the state file doesn't exist, it is initialized to the newest edit.
+func pollURLEdits(ctx context.Context, srv *server, opts *watchOptions) (int, error) {
+	st, ok, err := loadWatchState(opts.statePath)
+	if err != nil {
+		return 0, err
+	}
+	edits, err := findURLEdits(ctx, srv, st.LastEditID)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if len(edits) > 0 {
+			st.LastEditID = edits[len(edits)-1].id
+		}
+		log.Printf("Initializing watch state at edit %d", st.LastEditID)
+		return 0, saveWatchState(opts.statePath, st)
+	}
+
+	// If relationship changes are batched, the state is only saved after they're submitted.
+	batch := opts.urlOpts.batch
+	var n int
+	var procErr error
+	seen := make(map[string]struct{})
+loop:
+	for _, ed := range edits {
+		for _, mbid := range ed.urls {
+			if _, ok := seen[mbid]; ok {
+				continue
+			}
+			seen[mbid] = struct{}{}
+			n++
+			if err := processURL(ctx, srv, mbid, opts.urlOpts); isLimitErr(err) || ctx.Err() != nil {
+				procErr = err // retry this edit next time
+				break loop
+			} else if err != nil {
+				log.Printf("Failed processing %v from edit %d: %v", mbid, ed.id, err)
+			}
+		}
+		st.LastEditID = ed.id
+		if batch == nil {
+			if err := saveWatchState(opts.statePath, st); err != nil {
+				return n, err
+			}
+		}
+	}
+	if batch != nil {
+		if err := batch.flush(ctx); err != nil {
+			return n, err
+		}
+		if err := saveWatchState(opts.statePath, st); err != nil {
+			return n, err
+		}
+	}
+	return n, procErr
+}
+
+// urlEdit describes an edit that affected URL entities.
+type urlEdit struct {
+	id   int
+	urls []string // MBIDs
+}
+
+// findURLEdits searches srv for URL-related edits newer than the one with ID after.
+// Edits made by srv's own user are excluded. Edits are returned in ascending order by ID.
+// If after is 0, only the newest page of edits is returned.
+func findURLEdits(ctx context.Context, srv *server, after int) ([]urlEdit, error) {
+	vals := url.Values{
+		"combinator":            {"and"},
+		"negation":              {"0"},
+		"order":                 {"asc"},
+		"conditions.0.field":    {"type"},
+		"conditions.0.operator": {"="},
+		"conditions.0.args": {
+			strconv.Itoa(editTypeAddRel),
+			strconv.Itoa(editTypeEditRel),
+			strconv.Itoa(editTypeEditURL),
+		},
+		"conditions.1.field":    {"editor"},
+		"conditions.1.operator": {"not_me"},
+	}
+	if after == 0 {
+		vals.Set("order", "desc") // just look at the newest edits when there's no previous state
+	} else {
+		// Page through the edits oldest-first so that the ones that aren't fetched
+		// due to maxWatchPages will be picked up by the next poll.
+		vals.Set("conditions.2.field", "id")
+		vals.Set("conditions.2.operator", ">")
+		vals.Set("conditions.2.args.0", strconv.Itoa(after))
+	}
+
+	var edits []urlEdit
+	last := after
+	for page := 1; page <= maxWatchPages; page++ {
+		vals.Set("page", strconv.Itoa(page))
+		b, err := srv.get(ctx, "/search/edits?"+vals.Encode())
+		if err != nil {
+			return nil, err
+		}
+		found := parseEditSearch(b)
+		if after == 0 {
+			edits = found
+			break
+		}
+		if len(found) == 0 {
+			break
+		}
+		for _, ed := range found {
+			if ed.id > last {
+				edits = append(edits, ed)
+				last = ed.id
+			}
+		}
+		if page == maxWatchPages {
+			log.Printf("Stopping after %d pages of edits; remaining edits will be fetched by next poll", page)
+		}
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].id < edits[j].id })
+	return edits, nil
+}
+
+// editSearchRegexp matches links to edits and URL entities in edit search results.
+var editSearchRegexp = regexp.MustCompile(
+	`href="[^"]*/(?:edit/(\d+)|url/([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}))"`)
+
+// parseEditSearch parses an edit search results page and returns its edits in page order.
+// Each URL link is attributed to the most recent preceding edit link.
+func parseEditSearch(b []byte) []urlEdit {
+	var edits []urlEdit
+	for _, ms := range editSearchRegexp.FindAllSubmatch(b, -1) {
+		if len(ms[1]) > 0 {
+			id, _ := strconv.Atoi(string(ms[1]))
+			if len(edits) == 0 || edits[len(edits)-1].id != id {
+				edits = append(edits, urlEdit{id: id})
+			}
+		} else if len(edits) > 0 {
+			ed := &edits[len(edits)-1]
+			if mbid := string(ms[2]); !sliceContains(ed.urls, mbid) {
+				ed.urls = append(ed.urls, mbid)
+			}
+		}
+	}
+	return edits
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPollURLEdits(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	const (
+		mbid1 = "11111111-1111-1111-1111-111111111111"
+		mbid2 = "22222222-2222-2222-2222-222222222222"
+		mbid3 = "33333333-3333-3333-3333-333333333333"
+	)
+	env.mbidURLs[mbid1] = "https://listen.tidal.com/artist/1"
+	env.mbidURLs[mbid2] = "https://listen.tidal.com/artist/2"
+	env.mbidURLs[mbid3] = "https://listen.tidal.com/artist/3"
+	env.urlEdits[100] = []string{mbid1}
+
+	opts := watchOptions{
+		statePath: filepath.Join(t.TempDir(), "state.json"),
+		urlOpts:   &urlOptions{},
+	}
+
+	// The first poll should just record the newest edit.
+	if n, err := pollURLEdits(ctx, env.srv, &opts); err != nil || n != 0 {
+		t.Fatalf("First pollURLEdits(...) = %d, %v; want 0, nil", n, err)
+	}
+	if st, ok, err := loadWatchState(opts.statePath); err != nil || !ok || st.LastEditID != 100 {
+		t.Fatalf("loadWatchState(%q) = %+v, %v, %v; want edit 100", opts.statePath, st, ok, err)
+	}
+	if len(env.requests) != 0 {
+		t.Fatalf("First poll sent %d request(s)", len(env.requests))
+	}
+
+	// Add enough edits to span multiple pages. URLs should be processed in edit order,
+	// and only once per poll.
+	env.urlEdits[101] = []string{mbid2}
+	env.urlEdits[102] = []string{mbid3, mbid2}
+	env.urlEdits[103] = nil
+	env.urlEdits[104] = []string{mbid1}
+	if n, err := pollURLEdits(ctx, env.srv, &opts); err != nil || n != 3 {
+		t.Fatalf("Second pollURLEdits(...) = %d, %v; want 3, nil", n, err)
+	}
+	var got []string
+	for _, req := range env.requests {
+		got = append(got, req.path)
+	}
+	want := []string{"/url/" + mbid2 + "/edit", "/url/" + mbid3 + "/edit", "/url/" + mbid1 + "/edit"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error("Bad requests:\n" + diff)
+	}
+	if st, _, err := loadWatchState(opts.statePath); err != nil || st.LastEditID != 104 {
+		t.Errorf("loadWatchState(%q) = %+v, %v; want edit 104", opts.statePath, st, err)
+	}
+
+	// Edits made by the bot's own user should be ignored.
+	env.requests = nil
+	env.urlEdits[105] = []string{mbid2}
+	env.ownEdits[105] = true
+	env.urlEdits[106] = []string{mbid3}
+	if n, err := pollURLEdits(ctx, env.srv, &opts); err != nil || n != 1 {
+		t.Fatalf("Third pollURLEdits(...) = %d, %v; want 1, nil", n, err)
+	}
+	got = nil
+	for _, req := range env.requests {
+		got = append(got, req.path)
+	}
+	if diff := cmp.Diff([]string{"/url/" + mbid3 + "/edit"}, got); diff != "" {
+		t.Error("Bad requests:\n" + diff)
+	}
+	if st, _, err := loadWatchState(opts.statePath); err != nil || st.LastEditID != 106 {
+		t.Errorf("loadWatchState(%q) = %+v, %v; want edit 106", opts.statePath, st, err)
+	}
+
+	// Nothing should happen if there are no new edits.
+	env.requests = nil
+	if n, err := pollURLEdits(ctx, env.srv, &opts); err != nil || n != 0 {
+		t.Errorf("Fourth pollURLEdits(...) = %d, %v; want 0, nil", n, err)
+	}
+	if len(env.requests) != 0 {
+		t.Errorf("Fourth poll sent %d request(s)", len(env.requests))
+	}
+}
+
+func TestPollURLEdits_MaxPages(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(ctx, t)
+	defer env.close()
+
+	opts := watchOptions{
+		statePath: filepath.Join(t.TempDir(), "state.json"),
+		urlOpts:   &urlOptions{},
+	}
+	if err := saveWatchState(opts.statePath, watchState{LastEditID: 100}); err != nil {
+		t.Fatal("Failed saving state: ", err)
+	}
+
+	// Add more edits than can be fetched by a single poll.
+	const max = maxWatchPages * testEditSearchPageSize
+	for id := 101; id <= 100+max+1; id++ {
+		env.urlEdits[id] = nil
+	}
+
+	// The first poll should stop at the last edit that it fetched,
+	// and the second poll should pick up the remaining edit.
+	for i, want := range []int{100 + max, 100 + max + 1} {
+		if _, err := pollURLEdits(ctx, env.srv, &opts); err != nil {
+			t.Fatalf("pollURLEdits(...) #%d failed: %v", i+1, err)
+		}
+		if st, _, err := loadWatchState(opts.statePath); err != nil || st.LastEditID != want {
+			t.Errorf("loadWatchState(%q) after poll #%d = %+v, %v; want edit %d",
+				opts.statePath, i+1, st, err, want)
+		}
+	}
+}